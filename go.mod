@@ -3,8 +3,13 @@ module github.com/rmitchellscott/rm-qmd-hasher
 go 1.23
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/go-chi/chi/v5 v5.0.11
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.4.3
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.8.17
 )
+
+require golang.org/x/sys v0.29.0 // indirect
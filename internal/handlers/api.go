@@ -2,35 +2,48 @@ package handlers
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
 
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/hasher"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/qmldiff"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/workdir"
 	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
 )
 
 type APIHandler struct {
-	qmldiffService *qmldiff.Service
-	gcdCache       *gcdcache.Service
-	jobStore       *jobs.Store
+	hasher     hasher.Hasher
+	jobStore   *jobs.Store
+	jobQueue   *jobs.Queue
+	workdirs   *workdir.Manager
+	jobTimeout time.Duration
 }
 
-func NewAPIHandler(qmldiffService *qmldiff.Service, gcdCache *gcdcache.Service, jobStore *jobs.Store) *APIHandler {
+func NewAPIHandler(hashBackend hasher.Hasher, jobStore *jobs.Store, jobQueue *jobs.Queue, workdirs *workdir.Manager, jobTimeout time.Duration) *APIHandler {
 	return &APIHandler{
-		qmldiffService: qmldiffService,
-		gcdCache:       gcdCache,
-		jobStore:       jobStore,
+		hasher:     hashBackend,
+		jobStore:   jobStore,
+		jobQueue:   jobQueue,
+		workdirs:   workdirs,
+		jobTimeout: jobTimeout,
 	}
 }
 
@@ -41,222 +54,382 @@ func (h *APIHandler) Hash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	version := r.FormValue("version")
-	if version == "" {
-		writeJSONError(w, http.StatusBadRequest, "version is required")
+	if h.stillLoading(w, r.MultipartForm.Value) {
 		return
 	}
 
-	var fileHeaders []*multipart.FileHeader
-	var filePaths []string
+	versions, err := h.resolveVersions(r.MultipartForm.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if files := r.MultipartForm.File["files"]; len(files) > 0 {
-		fileHeaders = files
-		filePaths = r.MultipartForm.Value["paths"]
-	} else {
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			logging.Error(logging.ComponentHandler, "No files uploaded: %v", err)
-			writeJSONError(w, http.StatusBadRequest, "No file uploaded or invalid form data")
-			return
-		}
-		file.Close()
-		fileHeaders = []*multipart.FileHeader{header}
-		filePaths = []string{header.Filename}
+	devices := parseListValues(r.MultipartForm.Value["devices"])
+	if err := h.validateDevices(versions, devices); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	inputDir, err := os.MkdirTemp("", "hash-input-*")
-	if err != nil {
-		logging.Error(logging.ComponentHandler, "Failed to create input temp directory: %v", err)
-		writeJSONError(w, http.StatusInternalServerError, "Failed to create temp directory")
+	verify, _ := strconv.ParseBool(r.FormValue("verify"))
+
+	up, ok := h.receiveUploads(w, r)
+	if !ok {
 		return
 	}
 
-	outputDir, err := os.MkdirTemp("", "hash-output-*")
-	if err != nil {
-		os.RemoveAll(inputDir)
-		logging.Error(logging.ComponentHandler, "Failed to create output temp directory: %v", err)
-		writeJSONError(w, http.StatusInternalServerError, "Failed to create temp directory")
+	logging.Info(logging.ComponentHandler, "Received %d QMD file(s) for hashing with version(s) %s", len(up.qmdFiles), strings.Join(versions, ", "))
+
+	h.startJob(w, "hash", up, func(ctx context.Context, jobID string) {
+		h.processHashJob(ctx, jobID, "", versions, devices, verify, up)
+	})
+}
+
+// processHashJob hashes every uploaded file against the GCD of versions and
+// devices. When fromVersion is set the files are already hashed for that
+// version: they are unhashed with its device hashtabs first, which migrates
+// them to the target versions. With verify set, every hash in each output file
+// is checked against the hashtab of each target device.
+func (h *APIHandler) processHashJob(ctx context.Context, jobID, fromVersion string, versions, devices []string, verify bool, up *upload) {
+	defer os.RemoveAll(up.inputDir)
+
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
 		return
 	}
 
-	qmdFiles := make([]string, 0, len(fileHeaders))
-	relPaths := make([]string, 0, len(fileHeaders))
+	h.jobStore.UpdateWithOperation(jobID, "running", "Getting GCD hashtab", nil, "preparing")
 
-	for i, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
+	gcd, err := h.hasher.BuildGCD(versions, devices)
+	if err != nil {
+		version := strings.Join(versions, ", ")
+		logging.Error(logging.ComponentHandler, "Failed to get GCD hashtab for version %s: %v", version, err)
+		h.jobStore.Update(jobID, "error", fmt.Sprintf("Version %s not available: %v", version, err), nil)
+		os.RemoveAll(up.outputDir)
+		return
+	}
+	defer h.hasher.ReleaseGCD(gcd)
+	gcdPath := gcd.Path
+	h.jobStore.SetTarget(jobID, gcd.Versions, gcd.Devices, gcd.ExcludedCounts)
+
+	var migration *migrator
+	if fromVersion != "" {
+		migration, err = h.newMigrator(fromVersion, gcdPath)
 		if err != nil {
-			logging.Error(logging.ComponentHandler, "Failed to open uploaded file %s: %v", fileHeader.Filename, err)
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to open file %s", fileHeader.Filename))
+			logging.Error(logging.ComponentHandler, "Failed to prepare migration from %s: %v", fromVersion, err)
+			h.jobStore.Update(jobID, "error", fmt.Sprintf("Failed to prepare migration: %v", err), nil)
+			os.RemoveAll(up.outputDir)
 			return
 		}
+	}
 
-		var relativePath string
-		if i < len(filePaths) && filePaths[i] != "" {
-			relativePath = filepath.Clean(filePaths[i])
-		} else {
-			relativePath = filepath.Clean(fileHeader.Filename)
-		}
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
+		return
+	}
 
-		if !strings.HasSuffix(strings.ToLower(relativePath), ".qmd") {
-			file.Close()
-			continue
-		}
+	h.jobStore.UpdateWithOperation(jobID, "running", "Hashing files", nil, "hashing")
 
-		inputPath := filepath.Join(inputDir, relativePath)
-		outputPath := filepath.Join(outputDir, relativePath)
+	results := make([]jobs.FileResult, len(up.qmdFiles))
+	var prepared []int
+	var outputPaths []string
 
-		cleanInputDir := filepath.Clean(inputDir) + string(os.PathSeparator)
-		cleanInputPath := filepath.Clean(inputPath)
-		if !strings.HasPrefix(cleanInputPath+string(os.PathSeparator), cleanInputDir) {
-			file.Close()
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			logging.Warn(logging.ComponentHandler, "Path traversal attempt detected: %s", relativePath)
-			writeJSONError(w, http.StatusBadRequest, "Invalid file path")
+	for i, inputPath := range up.qmdFiles {
+		if h.jobInterrupted(ctx, jobID, up.outputDir) {
 			return
 		}
 
-		if err := os.MkdirAll(filepath.Dir(inputPath), 0755); err != nil {
-			file.Close()
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create directory for file %s", fileHeader.Filename))
-			return
+		relPath := up.relPaths[i]
+		outputPath := filepath.Join(up.outputDir, relPath)
+		result := &results[i]
+		result.Name = relPath
+		result.Path = relPath
+
+		if migration != nil {
+			if err := migration.unhash(inputPath, outputPath, result); err != nil {
+				logging.Error(logging.ComponentHandler, "Failed to unhash file %s: %v", relPath, err)
+				result.Status = "error"
+				result.Error = fmt.Sprintf("Unhashing failed: %v", err)
+				continue
+			}
+		} else if err := copyFile(inputPath, outputPath); err != nil {
+			logging.Error(logging.ComponentHandler, "Failed to copy file %s: %v", relPath, err)
+			result.Status = "error"
+			result.Error = fmt.Sprintf("Failed to copy file: %v", err)
+			continue
 		}
 
-		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
-			file.Close()
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create output directory for file %s", fileHeader.Filename))
-			return
-		}
+		result.Dropped = h.droppedIdentifiers(outputPath, gcd.Versions, gcd.Devices)
 
-		inputFile, err := os.Create(inputPath)
-		if err != nil {
-			file.Close()
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to save file %s", fileHeader.Filename))
-			return
-		}
+		prepared = append(prepared, i)
+		outputPaths = append(outputPaths, outputPath)
+	}
 
-		bytesWritten, err := io.Copy(inputFile, file)
-		file.Close()
-		inputFile.Close()
+	hashErrs := h.hasher.HashFiles(ctx, gcdPath, outputPaths, func(done int) {
+		h.jobStore.UpdateProgress(jobID, done*100/len(outputPaths))
+	})
+
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
+		return
+	}
+
+	successCount, unverifiedCount := 0, 0
+
+	for k, i := range prepared {
+		relPath := up.relPaths[i]
+		outputPath := outputPaths[k]
+		result := &results[i]
 
+		err := hashErrs[k]
+		var warning *hasher.UnresolvedWarning
+		if errors.As(err, &warning) {
+			logging.Debug(logging.ComponentHandler, "File %s: %v", relPath, warning)
+			result.Diagnostics = unresolvedDiagnostics(warning.Identifiers, relPath)
+			err = nil
+		}
 		if err != nil {
-			os.RemoveAll(inputDir)
-			os.RemoveAll(outputDir)
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to save file %s", fileHeader.Filename))
-			return
+			logging.Error(logging.ComponentHandler, "Failed to hash file %s: %v", relPath, err)
+			result.Status = "error"
+			result.Error = fmt.Sprintf("Hashing failed: %v", err)
+			var qerr *qmldiff.Error
+			if errors.As(err, &qerr) {
+				result.Diagnostics = fileDiagnostics(qerr.Diagnostics, up.outputDir, relPath)
+				result.Abnormal = qerr.Abnormal != ""
+			}
+			os.Remove(outputPath)
+			continue
 		}
 
-		if bytesWritten == 0 {
-			logging.Warn(logging.ComponentHandler, "Skipping empty file: %s", fileHeader.Filename)
-			continue
+		if verify {
+			v, err := h.hasher.Verify(ctx, outputPath, gcd.Versions, gcd.Devices)
+			if err != nil {
+				logging.Error(logging.ComponentHandler, "Failed to verify file %s: %v", relPath, err)
+				result.Status = "error"
+				result.Error = fmt.Sprintf("Verification failed: %v", err)
+				os.Remove(outputPath)
+				continue
+			}
+			result.Devices = v.Devices
+			result.Unhashed = v.Unhashed
+			if len(v.Unhashed) > 0 {
+				logging.Warn(logging.ComponentHandler, "File %s has %d identifier(s) left unhashed", relPath, len(v.Unhashed))
+			}
+			if v.Failed > 0 {
+				logging.Warn(logging.ComponentHandler, "File %s failed verification on %d device(s)", relPath, v.Failed)
+				result.Status = "error"
+				result.Error = fmt.Sprintf("Verification failed on %d device(s)", v.Failed)
+				result.Unverified = true
+				unverifiedCount++
+				continue
+			}
 		}
 
-		qmdFiles = append(qmdFiles, inputPath)
-		relPaths = append(relPaths, relativePath)
+		result.Status = "success"
+		successCount++
 	}
 
-	if len(qmdFiles) == 0 {
-		os.RemoveAll(inputDir)
-		os.RemoveAll(outputDir)
-		writeJSONError(w, http.StatusBadRequest, "No .qmd files uploaded")
+	h.jobStore.SetFiles(jobID, results)
+
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
 		return
 	}
 
-	logging.Info(logging.ComponentHandler, "Received %d QMD file(s) for hashing with version %s", len(qmdFiles), version)
+	if successCount == 0 && unverifiedCount > 0 {
+		h.jobStore.Update(jobID, "error", "All files failed verification", nil)
+		return
+	}
 
-	jobID := uuid.New().String()
-	job := h.jobStore.Create(jobID)
-	job.FileCount = len(qmdFiles)
-	h.jobStore.SetOutputDir(jobID, outputDir)
+	if successCount == 0 {
+		h.jobStore.Update(jobID, "error", "All files failed to hash", nil)
+		os.RemoveAll(up.outputDir)
+		return
+	}
 
-	go h.processHashJob(jobID, version, qmdFiles, relPaths, inputDir, outputDir)
+	logging.Info(logging.ComponentHandler, "Hashing complete for job %s: %d/%d files successful", jobID, successCount, len(up.qmdFiles))
+	h.jobStore.Update(jobID, "success", fmt.Sprintf("Hashed %d file(s)", successCount), nil)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"jobId": jobID,
-	})
+// absPathPattern matches an absolute path inside a diagnostic message.
+var absPathPattern = regexp.MustCompile("(?:^|[\\s'\"`(])(/[^\\s'\"`():,]+)")
+
+// fileDiagnostics rewrites the file of each diagnostic relative to the job's
+// output directory, and strips server paths from messages, so responses never
+// expose them. Diagnostics without a file are attributed to relPath.
+func fileDiagnostics(diags []qmldiff.Diagnostic, outputDir, relPath string) []jobs.Diagnostic {
+	result := make([]jobs.Diagnostic, len(diags))
+	for i, d := range diags {
+		d.Message = strings.ReplaceAll(d.Message, outputDir+string(filepath.Separator), "")
+		d.Message = absPathPattern.ReplaceAllStringFunc(d.Message, func(m string) string {
+			i := strings.IndexByte(m, '/')
+			return m[:i] + filepath.Base(m[i:])
+		})
+		switch {
+		case d.File == "":
+			d.File = relPath
+		case filepath.IsAbs(d.File):
+			if rel, err := filepath.Rel(outputDir, d.File); err == nil && !strings.HasPrefix(rel, "..") {
+				d.File = rel
+			} else {
+				d.File = filepath.Base(d.File)
+			}
+		}
+		result[i] = jobs.Diagnostic(d)
+	}
+	return result
 }
 
-func (h *APIHandler) processHashJob(jobID, version string, qmdFiles, relPaths []string, inputDir, outputDir string) {
-	defer os.RemoveAll(inputDir)
+// unresolvedDiagnostics reports, as warnings on relPath, the tokens a file
+// kept because the hashtab has no hash for them.
+func unresolvedDiagnostics(identifiers []string, relPath string) []jobs.Diagnostic {
+	result := make([]jobs.Diagnostic, len(identifiers))
+	for i, id := range identifiers {
+		result[i] = jobs.Diagnostic{
+			File:     relPath,
+			Severity: "warning",
+			Message:  fmt.Sprintf("'%s' is not in the hashtab and was left unhashed", id),
+			Token:    id,
+		}
+	}
+	return result
+}
 
-	h.jobStore.UpdateWithOperation(jobID, "running", "Getting GCD hashtab", nil, "preparing")
+// droppedIdentifiers lists the identifiers in the unhashed file at path that
+// the GCD of versions and devices lost. Failures are logged and yield nil, as
+// the report only explains hashing failures.
+func (h *APIHandler) droppedIdentifiers(path string, versions, devices []string) []jobs.DroppedIdentifier {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logging.Warn(logging.ComponentHandler, "Failed to read %s for GCD report: %v", path, err)
+		return nil
+	}
 
-	gcdPath, err := h.gcdCache.GetGCDHashtab(version)
+	dropped, err := h.hasher.DroppedIdentifiers(versions, devices, qmd.Identifiers(content))
 	if err != nil {
-		logging.Error(logging.ComponentHandler, "Failed to get GCD hashtab for version %s: %v", version, err)
-		h.jobStore.Update(jobID, "error", fmt.Sprintf("Version %s not available: %v", version, err), nil)
-		os.RemoveAll(outputDir)
-		return
+		logging.Warn(logging.ComponentHandler, "Failed to check dropped identifiers for %s: %v", path, err)
+		return nil
 	}
 
-	h.jobStore.UpdateWithOperation(jobID, "running", "Hashing files", nil, "hashing")
+	result := make([]jobs.DroppedIdentifier, len(dropped))
+	for i, d := range dropped {
+		result[i] = jobs.DroppedIdentifier(d)
+	}
+	return result
+}
 
-	results := make([]jobs.FileResult, 0, len(qmdFiles))
-	successCount := 0
+// jobInterrupted reports whether the job's context has ended. A timed-out job
+// is marked as failed; a cancelled job already has its terminal status. In
+// both cases the job's output is discarded.
+func (h *APIHandler) jobInterrupted(ctx context.Context, jobID, outputDir string) bool {
+	err := ctx.Err()
+	if err == nil {
+		return false
+	}
 
-	for i, inputPath := range qmdFiles {
-		relPath := relPaths[i]
-		outputPath := filepath.Join(outputDir, relPath)
+	os.RemoveAll(outputDir)
 
-		if err := copyFile(inputPath, outputPath); err != nil {
-			logging.Error(logging.ComponentHandler, "Failed to copy file %s: %v", relPath, err)
-			results = append(results, jobs.FileResult{
-				Name:   relPath,
-				Path:   relPath,
-				Status: "error",
-				Error:  fmt.Sprintf("Failed to copy file: %v", err),
-			})
-			continue
-		}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logging.Warn(logging.ComponentHandler, "Job %s timed out after %s", jobID, h.jobTimeout)
+		h.jobStore.Update(jobID, "error", fmt.Sprintf("Job timed out after %s", h.jobTimeout), nil)
+	} else {
+		logging.Info(logging.ComponentHandler, "Job %s cancelled", jobID)
+	}
 
-		if err := h.qmldiffService.HashDiffs(gcdPath, outputPath); err != nil {
-			logging.Error(logging.ComponentHandler, "Failed to hash file %s: %v", relPath, err)
-			results = append(results, jobs.FileResult{
-				Name:   relPath,
-				Path:   relPath,
-				Status: "error",
-				Error:  fmt.Sprintf("Hashing failed: %v", err),
-			})
-			os.Remove(outputPath)
-			continue
+	return true
+}
+
+// resolveVersions reads the target versions from the version, versions and
+// versionRange form fields.
+func (h *APIHandler) resolveVersions(values map[string][]string) ([]string, error) {
+	var versions []string
+
+	if ranges := values["versionRange"]; len(ranges) > 0 && ranges[0] != "" {
+		matched, err := h.hasher.VersionsMatching(ranges[0])
+		if err != nil {
+			return nil, err
 		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no versions available in range %s", ranges[0])
+		}
+		for _, v := range matched {
+			versions = append(versions, v.Version)
+		}
+	}
 
-		results = append(results, jobs.FileResult{
-			Name:   relPath,
-			Path:   relPath,
-			Status: "success",
-		})
-		successCount++
+	versions = append(versions, parseListValues(values["version"])...)
+	versions = append(versions, parseListValues(values["versions"])...)
 
-		progress := int(float64(i+1) / float64(len(qmdFiles)) * 100)
-		h.jobStore.UpdateProgress(jobID, progress)
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("version is required")
 	}
 
-	h.jobStore.SetFiles(jobID, results)
+	return versions, nil
+}
 
-	if successCount == 0 {
-		h.jobStore.Update(jobID, "error", "All files failed to hash", nil)
-		os.RemoveAll(outputDir)
-		return
+func (h *APIHandler) validateDevices(versions []string, devices []string) error {
+	if err := h.hasher.CheckLimits(versions, devices); err != nil {
+		return err
 	}
 
-	logging.Info(logging.ComponentHandler, "Hashing complete for job %s: %d/%d files successful", jobID, successCount, len(qmdFiles))
-	h.jobStore.Update(jobID, "success", fmt.Sprintf("Hashed %d file(s)", successCount), nil)
+	available := make(map[string]map[string]bool)
+	for _, v := range h.hasher.Versions() {
+		available[v.Version] = make(map[string]bool, len(v.Devices))
+		for _, d := range v.Devices {
+			available[v.Version][d] = true
+		}
+	}
+
+	for _, version := range versions {
+		versionDevices, ok := available[version]
+		if !ok {
+			return fmt.Errorf("version %s not available", version)
+		}
+		for _, d := range devices {
+			if !versionDevices[d] {
+				return fmt.Errorf("device %s not available for version %s", d, version)
+			}
+		}
+	}
+
+	return nil
+}
+
+// versionDevices returns the devices that have a hashtab loaded for version.
+func (h *APIHandler) versionDevices(version string) []string {
+	for _, v := range h.hasher.Versions() {
+		if v.Version == version {
+			return v.Devices
+		}
+	}
+	return nil
 }
 
 func (h *APIHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
-	versions := h.gcdCache.GetVersions()
+	versions := h.hasher.Versions()
+
+	if expr := r.URL.Query().Get("range"); expr != "" {
+		matched, err := h.hasher.VersionsMatching(expr)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		versions = matched
+	}
+
+	listed := make(map[string]bool, len(versions))
+	for i := range versions {
+		versions[i].Loading = h.hasher.Generating(versions[i].Version)
+		listed[versions[i].Version] = true
+	}
+
+	for _, v := range h.hasher.LoadingVersions() {
+		if listed[v] {
+			continue
+		}
+		if expr := r.URL.Query().Get("range"); expr != "" && !versionInRange(v, expr) {
+			continue
+		}
+		versions = append(versions, hashtab.VersionInfo{Version: v, Devices: []string{}, Loading: true})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return hashtab.CompareVersions(versions[i].Version, versions[j].Version) > 0
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -266,6 +439,103 @@ func (h *APIHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// loadingVersions returns the versions still being loaded at startup: those
+// whose hashtabs are being parsed and those among versions whose GCD is not
+// generated yet.
+func (h *APIHandler) loadingVersions(versions []hashtab.VersionInfo) []string {
+	loading := h.hasher.LoadingVersions()
+	for _, v := range versions {
+		if h.hasher.Generating(v.Version) && !slices.Contains(loading, v.Version) {
+			loading = append(loading, v.Version)
+		}
+	}
+	return loading
+}
+
+func versionInRange(version, expr string) bool {
+	constraints, err := hashtab.ParseConstraints(expr)
+	if err != nil {
+		return false
+	}
+	parsed, err := hashtab.ParseOSVersion(version)
+	if err != nil {
+		return false
+	}
+	return constraints.Check(parsed)
+}
+
+// GCDReport describes the GCD for a set of versions and devices, including
+// which entries a cross-version GCD had to exclude.
+func (h *APIHandler) GCDReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if h.stillLoading(w, query) {
+		return
+	}
+
+	versions, err := h.resolveVersions(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	devices := parseListValues(query["devices"])
+	if err := h.validateDevices(versions, devices); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	gcd, err := h.hasher.BuildGCD(versions, devices)
+	if err != nil {
+		logging.Error(logging.ComponentHandler, "Failed to get GCD hashtab for %v: %v", versions, err)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to build GCD: %v", err))
+		return
+	}
+	h.hasher.ReleaseGCD(gcd)
+
+	excluded := gcd.Excluded
+	if excluded == nil {
+		excluded = []gcdcache.ExcludedEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"versions":       gcd.Versions,
+		"devices":        gcd.Devices,
+		"entries":        gcd.Entries,
+		"excludedCounts": gcd.ExcludedCounts,
+		"excluded":       excluded,
+	})
+}
+
+func (h *APIHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	if jobID == "" {
+		writeJSONError(w, http.StatusBadRequest, "Job ID required")
+		return
+	}
+
+	if _, ok := h.jobStore.Get(jobID); !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	if !h.jobStore.Cancel(jobID) {
+		writeJSONError(w, http.StatusConflict, "Job already finished")
+		return
+	}
+
+	logging.Info(logging.ComponentHandler, "Cancellation requested for job %s", jobID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"jobId":  jobID,
+		"status": "cancelled",
+	})
+}
+
 func (h *APIHandler) GetResults(w http.ResponseWriter, r *http.Request) {
 	jobID := chi.URLParam(r, "jobId")
 	if jobID == "" {
@@ -273,7 +543,7 @@ func (h *APIHandler) GetResults(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, ok := h.jobStore.Get(jobID)
+	job, ok := h.jobStore.Snapshot(jobID)
 	if !ok {
 		writeJSONError(w, http.StatusNotFound, "Job not found")
 		return
@@ -281,24 +551,30 @@ func (h *APIHandler) GetResults(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	if job.Status != "success" && job.Status != "error" {
+	if !jobs.IsTerminal(job.Status) {
 		w.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":    job.Status,
-			"message":   job.Message,
-			"progress":  job.Progress,
-			"operation": job.Operation,
-			"fileCount": job.FileCount,
+			"status":        job.Status,
+			"message":       job.Message,
+			"progress":      job.Progress,
+			"operation":     job.Operation,
+			"fileCount":     job.FileCount,
+			"queuePosition": job.QueuePosition,
 		})
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    job.Status,
-		"message":   job.Message,
-		"files":     job.Files,
-		"fileCount": job.FileCount,
+		"type":           job.Type,
+		"status":         job.Status,
+		"message":        job.Message,
+		"files":          job.Files,
+		"fileCount":      job.FileCount,
+		"versions":       job.Versions,
+		"devices":        job.Devices,
+		"excludedCounts": job.Excluded,
+		"expiresAt":      job.ExpiresAt,
 	})
 }
 
@@ -309,13 +585,20 @@ func (h *APIHandler) Download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, ok := h.jobStore.Get(jobID)
+	job, ok := h.jobStore.Snapshot(jobID)
 	if !ok {
 		writeJSONError(w, http.StatusNotFound, "Job not found")
 		return
 	}
 
-	if job.Status != "success" {
+	downloadable := make([]jobs.FileResult, 0)
+	for _, f := range job.Files {
+		if f.Status == "success" || f.Unverified {
+			downloadable = append(downloadable, f)
+		}
+	}
+
+	if job.Status != "success" && (job.Status != "error" || len(downloadable) == 0) {
 		writeJSONError(w, http.StatusBadRequest, "Job not complete or failed")
 		return
 	}
@@ -325,33 +608,41 @@ func (h *APIHandler) Download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	successFiles := make([]jobs.FileResult, 0)
-	for _, f := range job.Files {
-		if f.Status == "success" {
-			successFiles = append(successFiles, f)
-		}
-	}
-
-	if len(successFiles) == 0 {
+	if len(downloadable) == 0 {
 		writeJSONError(w, http.StatusBadRequest, "No successfully hashed files to download")
 		return
 	}
 
-	if len(successFiles) == 1 {
-		filePath := filepath.Join(job.OutputDir, successFiles[0].Path)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(successFiles[0].Name)))
+	for _, f := range downloadable {
+		if _, err := os.Stat(filepath.Join(job.OutputDir, f.Path)); err != nil {
+			logging.Error(logging.ComponentHandler, "Output of job %s is missing: %v", jobID, err)
+			writeJSONError(w, http.StatusGone, "Job output is no longer available")
+			return
+		}
+	}
+
+	if len(downloadable) == 1 {
+		filePath := filepath.Join(job.OutputDir, downloadable[0].Path)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(downloadable[0].Name)))
 		w.Header().Set("Content-Type", "application/octet-stream")
 		http.ServeFile(w, r, filePath)
 		return
 	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename=\"hashed-files.zip\"")
+	zipName := "hashed-files.zip"
+	switch job.Type {
+	case "unhash":
+		zipName = "unhashed-files.zip"
+	case "migrate":
+		zipName = "migrated-files.zip"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", zipName))
 	w.Header().Set("Content-Type", "application/zip")
 
 	zipWriter := zip.NewWriter(w)
 	defer zipWriter.Close()
 
-	for _, f := range successFiles {
+	for _, f := range downloadable {
 		filePath := filepath.Join(job.OutputDir, f.Path)
 
 		file, err := os.Open(filePath)
@@ -375,6 +666,19 @@ func (h *APIHandler) Download(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// parseListValues flattens repeated and comma-separated form values.
+func parseListValues(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
+
 func writeJSONError(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/qmldiff"
+)
+
+func TestFileDiagnostics(t *testing.T) {
+	outputDir := "/tmp/rm-qmd-hasher/hash-output-123"
+	diags := []qmldiff.Diagnostic{
+		{File: outputDir + "/folder/file1.qmd", Line: 3, Severity: "error", Message: "unknown identifier 'x' in " + outputDir + "/folder/file1.qmd"},
+		{File: "/app/gcd-hashtabs/abc.gcd", Severity: "error", Message: "failed to read '/app/gcd-hashtabs/abc.gcd': truncated"},
+		{Severity: "error", Message: "memory allocation of 64 bytes failed"},
+	}
+
+	got := fileDiagnostics(diags, outputDir, "folder/file1.qmd")
+	want := []jobs.Diagnostic{
+		{File: "folder/file1.qmd", Line: 3, Severity: "error", Message: "unknown identifier 'x' in folder/file1.qmd"},
+		{File: "abc.gcd", Severity: "error", Message: "failed to read 'abc.gcd': truncated"},
+		{File: "folder/file1.qmd", Severity: "error", Message: "memory allocation of 64 bytes failed"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fileDiagnostics:\n got %+v\nwant %+v", got, want)
+	}
+}
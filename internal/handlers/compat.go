@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+// Compatibility checks every hash referenced by the uploaded hashed QMD files
+// against every loaded hashtab and reports, per version and device, which of
+// them are missing.
+func (h *APIHandler) Compatibility(w http.ResponseWriter, r *http.Request) {
+	if h.stillLoading(w, nil) {
+		return
+	}
+
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		logging.Error(logging.ComponentHandler, "Failed to parse multipart form: %v", err)
+		writeJSONError(w, http.StatusBadRequest, "Failed to parse form data")
+		return
+	}
+
+	fileHeaders := r.MultipartForm.File["files"]
+	if len(fileHeaders) == 0 {
+		fileHeaders = r.MultipartForm.File["file"]
+	}
+	if len(fileHeaders) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No file uploaded or invalid form data")
+		return
+	}
+
+	seen := make(map[uint64]bool)
+	var hashes []uint64
+	for _, fileHeader := range fileHeaders {
+		content, err := readUpload(fileHeader)
+		if err != nil {
+			logging.Error(logging.ComponentHandler, "Failed to read uploaded file %s: %v", fileHeader.Filename, err)
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to read file %s", fileHeader.Filename))
+			return
+		}
+		for _, hash := range qmd.HashedRefs(content) {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+
+	matrix := h.hasher.Compatibility(hashes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hashCount": len(hashes),
+		"versions":  matrix,
+	})
+}
+
+func readUpload(fileHeader *multipart.FileHeader) ([]byte, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func TestCompatibility(t *testing.T) {
+	server := newTestServer(t, newNativeBackend(t, map[string][]string{
+		"3.22.0.64-rm2":   {"width"},
+		"3.24.0.149-rm2":  {"width", "statusBar"},
+		"3.24.0.149-rmpp": {"width"},
+	}))
+	h := func(id string) string { return fmt.Sprintf("[[%d]]", hashtab.DJB2Hash(id)) }
+
+	resp := server.postFiles(t, "/api/compatibility", nil, map[string]string{
+		"a.qmd": "AFFECT " + h("statusBar") + " { " + h("width") + ": 1 }",
+		"b.qmd": "AFFECT " + h("width") + " { label: 1 }",
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var result struct {
+		HashCount int                            `json:"hashCount"`
+		Versions  []hashtab.VersionCompatibility `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashes the files share are checked once.
+	if result.HashCount != 2 {
+		t.Errorf("hashCount = %d, want 2", result.HashCount)
+	}
+	statusBar := strconv.FormatUint(hashtab.DJB2Hash("statusBar"), 10)
+	got := make(map[string][]string)
+	for _, row := range result.Versions {
+		for _, cell := range row.Devices {
+			got[row.Version+" "+cell.Device] = cell.Missing
+		}
+	}
+	want := map[string][]string{
+		"3.24.0.149 rm2":  {},
+		"3.24.0.149 rmpp": {statusBar},
+		"3.22.0.64 rm2":   {statusBar},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("missing = %v, want %v", got, want)
+	}
+}
+
+func TestCompatibilityWhileLoading(t *testing.T) {
+	backend := newFakeHasher()
+	backend.loaded = false
+	backend.loading = []string{"3.22.0.64"}
+	server := newTestServer(t, backend)
+
+	resp := server.postFiles(t, "/api/compatibility", nil, map[string]string{"a.qmd": "[[1]]"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 until every version is loaded", resp.StatusCode)
+	}
+}
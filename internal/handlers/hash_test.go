@@ -0,0 +1,688 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/hasher"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/workdir"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+// fakeHasher is a Hasher backed by fixed versions. It marks a file as hashed
+// by prefixing "hashed: ", so tests can tell its output from the upload. It
+// fails files that mention "broken", warns about files that mention "myLabel"
+// and blocks on files that mention "block" until the job's context ends.
+type fakeHasher struct {
+	loaded     bool
+	loading    []string
+	versions   []hashtab.VersionInfo
+	loadErrors map[string]string
+
+	// blocked receives a value when hashing of a "block" file starts.
+	blocked chan struct{}
+
+	mu       sync.Mutex
+	gcdCalls [][2][]string
+	gcdsHeld int
+}
+
+var _ hasher.Hasher = (*fakeHasher)(nil)
+
+func newFakeHasher() *fakeHasher {
+	return &fakeHasher{
+		loaded:  true,
+		blocked: make(chan struct{}, 1),
+		versions: []hashtab.VersionInfo{
+			{Version: "3.24.0.149", Devices: []string{"rm2", "rmpp"}, DeviceCount: 2},
+			{Version: "3.22.0.64", Devices: []string{"rm2"}, DeviceCount: 1},
+		},
+	}
+}
+
+func (f *fakeHasher) Name() string { return "fake" }
+
+func (f *fakeHasher) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	content, err := os.ReadFile(qmdPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte("broken")) {
+		return errors.New("syntax error")
+	}
+	if bytes.Contains(content, []byte("block")) {
+		f.blocked <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := os.WriteFile(qmdPath, append([]byte("hashed: "), content...), 0644); err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte("myLabel")) {
+		return &hasher.UnresolvedWarning{Identifiers: []string{"myLabel"}}
+	}
+	return nil
+}
+
+func (f *fakeHasher) HashFiles(ctx context.Context, hashtabPath string, qmdPaths []string, progress func(done int)) []error {
+	errs := make([]error, len(qmdPaths))
+	for i, path := range qmdPaths {
+		errs[i] = f.HashDiffs(ctx, hashtabPath, path)
+		progress(i + 1)
+	}
+	return errs
+}
+
+func (f *fakeHasher) Loaded() bool { return f.loaded }
+
+func (f *fakeHasher) LoadingVersions() []string { return f.loading }
+
+func (f *fakeHasher) GCDsReady() bool { return f.loaded }
+
+func (f *fakeHasher) Generating(version string) bool { return false }
+
+func (f *fakeHasher) LoadErrors() map[string]string { return f.loadErrors }
+
+func (f *fakeHasher) Hashtabs() []*hashtab.Hashtab { return nil }
+
+func (f *fakeHasher) HashtabDir() string { return "/srv/hashtabs" }
+
+func (f *fakeHasher) Versions() []hashtab.VersionInfo {
+	return append([]hashtab.VersionInfo(nil), f.versions...)
+}
+
+func (f *fakeHasher) VersionsMatching(expr string) ([]hashtab.VersionInfo, error) {
+	constraints, err := hashtab.ParseConstraints(expr)
+	if err != nil {
+		return nil, err
+	}
+	var matched []hashtab.VersionInfo
+	for _, v := range f.versions {
+		parsed, _ := hashtab.ParseOSVersion(v.Version)
+		if constraints.Check(parsed) {
+			matched = append(matched, v)
+		}
+	}
+	return matched, nil
+}
+
+func (f *fakeHasher) CheckLimits(versions, devices []string) error {
+	if len(devices) > 2 {
+		return fmt.Errorf("%w: too many devices", gcdcache.ErrLimitExceeded)
+	}
+	return nil
+}
+
+func (f *fakeHasher) BuildGCD(versions, devices []string) (*gcdcache.GCDHashtab, error) {
+	f.mu.Lock()
+	f.gcdCalls = append(f.gcdCalls, [2][]string{versions, devices})
+	f.gcdsHeld++
+	f.mu.Unlock()
+	return &gcdcache.GCDHashtab{Versions: versions, Devices: devices, Path: "fake.gcd"}, nil
+}
+
+func (f *fakeHasher) ReleaseGCD(gcd *gcdcache.GCDHashtab) {
+	f.mu.Lock()
+	f.gcdsHeld--
+	f.mu.Unlock()
+}
+
+// held returns the number of GCDs built and not yet released.
+func (f *fakeHasher) held() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gcdsHeld
+}
+
+func (f *fakeHasher) DroppedIdentifiers(versions, devices, identifiers []string) ([]gcdcache.DroppedIdentifier, error) {
+	return nil, nil
+}
+
+// Verify fails files that contain "height" on rmpp.
+func (f *fakeHasher) Verify(ctx context.Context, path string, versions, devices []string) (*hasher.Verification, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &hasher.Verification{Devices: map[string]jobs.DeviceResult{"rm2": {Passed: true}}}
+	if bytes.Contains(content, []byte("height")) {
+		v.Devices["rmpp"] = jobs.DeviceResult{Missing: []string{"height"}}
+		v.Failed = 1
+		v.Unhashed = []string{"height"}
+	}
+	return v, nil
+}
+
+func (f *fakeHasher) Compatibility(hashes []uint64) []hashtab.VersionCompatibility {
+	return nil
+}
+
+func (f *fakeHasher) Resolver(version string) *hashtab.Resolver {
+	return hashtab.NewResolver(nil)
+}
+
+// Unhash resolves [[1]] to "width" and no other hash.
+func (f *fakeHasher) Unhash(content []byte, version string) ([]byte, []uint64) {
+	return qmd.Unhash(content, func(hash uint64) (string, bool) {
+		return "width", hash == 1
+	})
+}
+
+type testServer struct {
+	*httptest.Server
+	store *jobs.Store
+}
+
+func newTestServer(t *testing.T, backend hasher.Hasher) *testServer {
+	t.Helper()
+	return newTestServerWithTimeout(t, backend, time.Minute)
+}
+
+// newTestServerWithTimeout is newTestServer with jobs limited to jobTimeout.
+func newTestServerWithTimeout(t *testing.T, backend hasher.Hasher, jobTimeout time.Duration) *testServer {
+	t.Helper()
+
+	store, err := jobs.NewStore(jobs.MemoryBackend{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workdirs, err := workdir.NewManager(t.TempDir(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := jobs.NewQueue(store, 1, 10)
+
+	h := NewAPIHandler(backend, store, queue, workdirs, jobTimeout)
+
+	r := chi.NewRouter()
+	r.Post("/api/hash", h.Hash)
+	r.Post("/api/unhash", h.Unhash)
+	r.Post("/api/migrate", h.Migrate)
+	r.Post("/api/compatibility", h.Compatibility)
+	r.Get("/api/hashtabs", h.ListHashtabs)
+	r.Get("/api/hashtabs/lookup", h.LookupHashtabs)
+	r.Get("/api/versions", h.ListVersions)
+	r.Get("/readyz", h.Ready)
+	r.Get("/api/results/{jobId}", h.GetResults)
+	r.Delete("/api/jobs/{jobId}", h.CancelJob)
+	r.Get("/api/download/{jobId}", h.Download)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return &testServer{Server: server, store: store}
+}
+
+// postHash uploads files, by name, with the given form fields.
+func (s *testServer) postHash(t *testing.T, fields map[string]string, files map[string]string) *http.Response {
+	t.Helper()
+	return s.postFiles(t, "/api/hash", fields, files)
+}
+
+// postFiles posts files, each with its name as its path, and fields to path
+// as a multipart form.
+func (s *testServer) postFiles(t *testing.T, path string, fields map[string]string, files map[string]string) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, content)
+		mw.WriteField("paths", name)
+	}
+	mw.Close()
+
+	resp, err := http.Post(s.URL+path, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// eventually reports whether cond becomes true within a few seconds, for
+// what a job's goroutine does after the job reaches its terminal status.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// waitForJob polls the job until it reaches a terminal status.
+func (s *testServer) waitForJob(t *testing.T, jobID string) *jobs.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := s.store.Snapshot(jobID); ok && jobs.IsTerminal(job.Status) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", jobID)
+	return nil
+}
+
+func decodeJobID(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var result struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.JobID
+}
+
+func TestHashJob(t *testing.T) {
+	backend := newFakeHasher()
+	server := newTestServer(t, backend)
+
+	resp := server.postHash(t, map[string]string{"version": "3.24.0.149", "devices": "rm2"}, map[string]string{
+		"good.qmd": "AFFECT root { width: 1 }",
+		"warn.qmd": "AFFECT root { id: myLabel }",
+		"bad.qmd":  "AFFECT root { broken",
+	})
+	jobID := decodeJobID(t, resp)
+	job := server.waitForJob(t, jobID)
+
+	if job.Status != "success" {
+		t.Fatalf("job status = %q (%s), want success", job.Status, job.Message)
+	}
+	if want := [][2][]string{{{"3.24.0.149"}, {"rm2"}}}; !reflect.DeepEqual(backend.gcdCalls, want) {
+		t.Errorf("BuildGCD calls = %v, want %v", backend.gcdCalls, want)
+	}
+	// The GCD is released as the job goroutine returns, just after the
+	// job is marked done.
+	if !eventually(func() bool { return backend.held() == 0 }) {
+		t.Errorf("%d GCD(s) still held after the job finished", backend.held())
+	}
+
+	byName := make(map[string]jobs.FileResult)
+	for _, f := range job.Files {
+		byName[f.Name] = f
+	}
+	if got := byName["good.qmd"]; got.Status != "success" {
+		t.Errorf("good.qmd = %+v, want success", got)
+	}
+	if warn := byName["warn.qmd"]; warn.Status != "success" || len(warn.Diagnostics) != 1 || warn.Diagnostics[0].Token != "myLabel" || warn.Diagnostics[0].Severity != "warning" {
+		t.Errorf("warn.qmd = %+v, want success with a warning about myLabel", warn)
+	}
+	if bad := byName["bad.qmd"]; bad.Status != "error" || !strings.Contains(bad.Error, "syntax error") {
+		t.Errorf("bad.qmd = %+v, want a syntax error", bad)
+	}
+
+	dl, err := http.Get(server.URL + "/api/download/" + jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Body.Close()
+	content, _ := io.ReadAll(dl.Body)
+	if dl.StatusCode != http.StatusOK {
+		t.Fatalf("download = %d %s", dl.StatusCode, content)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		downloaded[f.Name] = string(data)
+	}
+	want := map[string]string{"good.qmd": "hashed: AFFECT root { width: 1 }", "warn.qmd": "hashed: AFFECT root { id: myLabel }"}
+	if !reflect.DeepEqual(downloaded, want) {
+		t.Errorf("download = %q, want %q", downloaded, want)
+	}
+}
+
+func TestHashKeepsUnverifiedOutput(t *testing.T) {
+	server := newTestServer(t, newFakeHasher())
+
+	resp := server.postHash(t, map[string]string{"version": "3.24.0.149", "verify": "true"}, map[string]string{
+		"a.qmd": "AFFECT root { width: 1; height: 2 }",
+	})
+	jobID := decodeJobID(t, resp)
+	job := server.waitForJob(t, jobID)
+
+	if job.Status != "error" || len(job.Files) != 1 {
+		t.Fatalf("job = %s %+v, want an error with one file", job.Status, job.Files)
+	}
+	f := job.Files[0]
+	if !f.Unverified || f.Devices["rmpp"].Passed || !reflect.DeepEqual(f.Unhashed, []string{"height"}) {
+		t.Errorf("file = %+v, want it unverified on rmpp with height unhashed", f)
+	}
+
+	dl, err := http.Get(server.URL + "/api/download/" + jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Body.Close()
+	content, _ := io.ReadAll(dl.Body)
+	if dl.StatusCode != http.StatusOK || string(content) != "hashed: AFFECT root { width: 1; height: 2 }" {
+		t.Errorf("download = %d %q, want the unverified output", dl.StatusCode, content)
+	}
+}
+
+func TestHashRejectsBadTargets(t *testing.T) {
+	server := newTestServer(t, newFakeHasher())
+
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   string
+	}{
+		{"missing version", map[string]string{}, "version is required"},
+		{"unknown version", map[string]string{"version": "9.9"}, "version 9.9 not available"},
+		{"unknown device", map[string]string{"version": "3.22.0.64", "devices": "rmpp"}, "device rmpp not available for version 3.22.0.64"},
+		{"too many devices", map[string]string{"version": "3.24.0.149", "devices": "rm1,rm2,rmpp"}, "too many devices"},
+		{"empty range", map[string]string{"versionRange": "4.0-4.1"}, "no versions available in range 4.0-4.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := server.postHash(t, tt.fields, map[string]string{"a.qmd": "AFFECT root {}"})
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), tt.want) {
+				t.Errorf("response = %d %s, want 400 containing %q", resp.StatusCode, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveVersions(t *testing.T) {
+	h := &APIHandler{hasher: newFakeHasher()}
+
+	tests := []struct {
+		name   string
+		values url.Values
+		want   []string
+		err    string
+	}{
+		{"version", url.Values{"version": {"3.24.0.149"}}, []string{"3.24.0.149"}, ""},
+		{"versions list", url.Values{"versions": {"3.22.0.64, 3.24.0.149"}}, []string{"3.22.0.64", "3.24.0.149"}, ""},
+		{"range and version", url.Values{"versionRange": {">=3.20 <3.23"}, "version": {"3.24.0.149"}}, []string{"3.22.0.64", "3.24.0.149"}, ""},
+		{"empty range", url.Values{"versionRange": {"4.0-4.1"}}, nil, "no versions available in range 4.0-4.1"},
+		{"nothing", url.Values{"versions": {" , "}}, nil, "version is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.resolveVersions(tt.values)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveVersions = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDevices(t *testing.T) {
+	h := &APIHandler{hasher: newFakeHasher()}
+
+	tests := []struct {
+		name     string
+		versions []string
+		devices  []string
+		err      string
+	}{
+		{"every device", []string{"3.22.0.64", "3.24.0.149"}, nil, ""},
+		{"subset of one version", []string{"3.24.0.149"}, []string{"rmpp"}, ""},
+		{"subset on every version", []string{"3.22.0.64", "3.24.0.149"}, []string{"rm2"}, ""},
+		{"missing on one version", []string{"3.24.0.149", "3.22.0.64"}, []string{"rmpp"}, "device rmpp not available for version 3.22.0.64"},
+		{"unknown version", []string{"3.20.0.1"}, []string{"rm2"}, "version 3.20.0.1 not available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.validateDevices(tt.versions, tt.devices)
+			if (tt.err == "" && err != nil) || (tt.err != "" && (err == nil || err.Error() != tt.err)) {
+				t.Errorf("validateDevices = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHashWhileLoading(t *testing.T) {
+	backend := newFakeHasher()
+	backend.loaded = false
+	server := newTestServer(t, backend)
+
+	tests := []struct {
+		name    string
+		loading []string
+		fields  map[string]string
+		want    int
+	}{
+		{"before the first scan", nil, map[string]string{"version": "3.24.0.149"}, http.StatusServiceUnavailable},
+		{"version loading", []string{"3.22.0.64"}, map[string]string{"version": "3.22.0.64"}, http.StatusServiceUnavailable},
+		{"range loading", []string{"3.22.0.64"}, map[string]string{"versionRange": "3.20-3.24"}, http.StatusServiceUnavailable},
+		{"other version loading", []string{"3.22.0.64"}, map[string]string{"version": "3.24.0.149"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.loading = tt.loading
+			resp := server.postHash(t, tt.fields, map[string]string{"a.qmd": "AFFECT root {}"})
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+				t.Error("missing Retry-After header")
+			}
+		})
+	}
+}
+
+func TestListVersionsWhileLoading(t *testing.T) {
+	backend := newFakeHasher()
+	backend.loaded = false
+	backend.loading = []string{"3.26.0.68"}
+	server := newTestServer(t, backend)
+
+	resp, err := http.Get(server.URL + "/api/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Versions []hashtab.VersionInfo `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, v := range result.Versions {
+		got = append(got, fmt.Sprintf("%s loading=%t", v.Version, v.Loading))
+	}
+	want := []string{"3.26.0.68 loading=true", "3.24.0.149 loading=false", "3.22.0.64 loading=false"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+}
+
+func TestReadyHidesHashtabDir(t *testing.T) {
+	backend := newFakeHasher()
+	backend.loadErrors = map[string]string{
+		"/srv/hashtabs/vendor/3.24.0.149-rm2": "checksum mismatch: /srv/hashtabs/vendor/3.24.0.149-rm2.yaml declares sha256 abc, file has def",
+	}
+	server := newTestServer(t, backend)
+
+	resp, err := http.Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Ready  bool              `json:"ready"`
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !result.Ready {
+		t.Errorf("status = %d, ready = %t, want 200 and ready", resp.StatusCode, result.Ready)
+	}
+	want := map[string]string{
+		"vendor/3.24.0.149-rm2": "checksum mismatch: vendor/3.24.0.149-rm2.yaml declares sha256 abc, file has def",
+	}
+	if !reflect.DeepEqual(result.Errors, want) {
+		t.Errorf("errors = %v, want %v", result.Errors, want)
+	}
+}
+
+func deleteJob(t *testing.T, url string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCancelJob(t *testing.T) {
+	backend := newFakeHasher()
+	server := newTestServer(t, backend)
+
+	jobID := decodeJobID(t, server.postHash(t, map[string]string{"version": "3.24.0.149"}, map[string]string{
+		"a.qmd": "AFFECT root { block }",
+	}))
+	select {
+	case <-backend.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not start hashing")
+	}
+	running, _ := server.store.Snapshot(jobID)
+	if running.OutputDir == "" {
+		t.Fatal("running job has no output directory")
+	}
+
+	if status := deleteJob(t, server.URL+"/api/jobs/"+jobID); status != http.StatusOK {
+		t.Fatalf("DELETE = %d, want 200", status)
+	}
+	job := server.waitForJob(t, jobID)
+	if job.Status != "cancelled" {
+		t.Errorf("job status = %q, want cancelled", job.Status)
+	}
+	// The hashing call returns once its context ends, and the job's output
+	// is discarded.
+	if !eventually(func() bool {
+		_, err := os.Stat(running.OutputDir)
+		return os.IsNotExist(err)
+	}) {
+		t.Errorf("output directory %s of the cancelled job was kept", running.OutputDir)
+	}
+
+	if status := deleteJob(t, server.URL+"/api/jobs/"+jobID); status != http.StatusConflict {
+		t.Errorf("DELETE of a finished job = %d, want 409", status)
+	}
+	if status := deleteJob(t, server.URL+"/api/jobs/unknown"); status != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown job = %d, want 404", status)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	server := newTestServerWithTimeout(t, newFakeHasher(), 50*time.Millisecond)
+
+	jobID := decodeJobID(t, server.postHash(t, map[string]string{"version": "3.24.0.149"}, map[string]string{
+		"a.qmd": "AFFECT root { block }",
+	}))
+	job := server.waitForJob(t, jobID)
+
+	if job.Status != "error" || job.Message != "Job timed out after 50ms" {
+		t.Errorf("job = %s %q, want an error saying it timed out", job.Status, job.Message)
+	}
+}
+
+func TestUnhashJob(t *testing.T) {
+	server := newTestServer(t, newFakeHasher())
+
+	resp := server.postFiles(t, "/api/unhash", map[string]string{"version": "3.22.0.64"}, map[string]string{
+		"a.qmd": "AFFECT [[7]] { [[1]]: [[2]] + [[2]] }",
+	})
+	jobID := decodeJobID(t, resp)
+	job := server.waitForJob(t, jobID)
+
+	if job.Status != "success" || job.Type != "unhash" || len(job.Files) != 1 {
+		t.Fatalf("job = %s %s %+v, want a successful unhash job with one file", job.Status, job.Type, job.Files)
+	}
+	if f := job.Files[0]; !reflect.DeepEqual(f.Unresolved, []string{"7", "2"}) {
+		t.Errorf("unresolved = %v, want each unknown hash once", f.Unresolved)
+	}
+
+	dl, err := http.Get(server.URL + "/api/download/" + jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Body.Close()
+	content, _ := io.ReadAll(dl.Body)
+	if want := "AFFECT [[7]] { width: [[2]] + [[2]] }"; string(content) != want {
+		t.Errorf("download = %q, want %q", content, want)
+	}
+}
+
+func TestUnhashRejectsUnknownVersion(t *testing.T) {
+	server := newTestServer(t, newFakeHasher())
+
+	for _, version := range []string{"", "9.9"} {
+		resp := server.postFiles(t, "/api/unhash", map[string]string{"version": version}, map[string]string{"a.qmd": "[[1]]"})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("version %q: status = %d, want 400", version, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// HashtabInfo describes one loaded hashtab.
+type HashtabInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Device  string `json:"device"`
+	// Format is "hashtab" when the file stores strings and "hashlist" when it
+	// only stores hashes.
+	Format  string `json:"format"`
+	Entries int    `json:"entries"`
+	// EmbeddedVersion is the version string stored in the file, if any.
+	EmbeddedVersion string `json:"embeddedVersion,omitempty"`
+	SHA256          string `json:"sha256"`
+	Hardware        string `json:"hardware,omitempty"`
+	Channel         string `json:"channel,omitempty"`
+	Manifest        string `json:"manifest,omitempty"`
+}
+
+// HashtabMatch reports whether one hashtab contains a looked-up hash, and
+// the string it stores for it. The string is empty in a hashlist.
+type HashtabMatch struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Device  string `json:"device"`
+	Present bool   `json:"present"`
+	String  string `json:"string,omitempty"`
+}
+
+// ListHashtabs describes every loaded hashtab, optionally filtered by the
+// version and devices query parameters.
+func (h *APIHandler) ListHashtabs(w http.ResponseWriter, r *http.Request) {
+	tables, err := h.selectHashtabs(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	infos := make([]HashtabInfo, 0, len(tables))
+	totalEntries := 0
+	for _, ht := range tables {
+		format := "hashtab"
+		if ht.IsHashlist() {
+			format = "hashlist"
+		}
+		embedded, _ := ht.Lookup(hashtab.VersionHash)
+
+		infos = append(infos, HashtabInfo{
+			Name:            ht.Name,
+			Path:            h.relativeHashtabPath(ht.Path),
+			Version:         ht.OSVersion,
+			Device:          ht.Device,
+			Format:          format,
+			Entries:         ht.Len(),
+			EmbeddedVersion: embedded,
+			SHA256:          ht.SHA256(),
+			Hardware:        ht.Hardware,
+			Channel:         ht.Channel,
+			Manifest:        h.relativeHashtabPath(ht.Manifest),
+		})
+		totalEntries += ht.Len()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hashtabs":     infos,
+		"count":        len(infos),
+		"totalEntries": totalEntries,
+	})
+}
+
+// LookupHashtabs looks up a hash, or the DJB2 hash of a string, in every
+// loaded hashtab matching the version and devices query parameters, and
+// reports which of them contain it.
+func (h *APIHandler) LookupHashtabs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	hashParam := query.Get("hash")
+	str := query.Get("string")
+
+	if (hashParam == "") == (str == "") {
+		writeJSONError(w, http.StatusBadRequest, "exactly one of hash or string is required")
+		return
+	}
+
+	var hash uint64
+	if str != "" {
+		hash = hashtab.DJB2Hash(str)
+	} else {
+		parsed, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(hashParam, "[["), "]]"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid hash %q", hashParam))
+			return
+		}
+		hash = parsed
+	}
+
+	tables, err := h.selectHashtabs(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	matches := make([]HashtabMatch, 0, len(tables))
+	present := 0
+	for _, ht := range tables {
+		stored, ok := ht.Lookup(hash)
+		matches = append(matches, HashtabMatch{
+			Name:    ht.Name,
+			Version: ht.OSVersion,
+			Device:  ht.Device,
+			Present: ok,
+			String:  stored,
+		})
+		if ok {
+			present++
+		}
+	}
+
+	response := map[string]interface{}{
+		"hash":     strconv.FormatUint(hash, 10),
+		"present":  present,
+		"hashtabs": matches,
+	}
+	if str != "" {
+		response["string"] = str
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// selectHashtabs returns the loaded hashtabs matching the request's version
+// filter, which takes the same syntax as /api/versions?range=, and devices.
+// It is an error for the filters to match nothing.
+func (h *APIHandler) selectHashtabs(r *http.Request) ([]*hashtab.Hashtab, error) {
+	query := r.URL.Query()
+	devices := parseListValues(query["devices"])
+	if device := query.Get("device"); device != "" {
+		devices = append(devices, device)
+	}
+
+	var constraints hashtab.Constraints
+	if expr := query.Get("version"); expr != "" {
+		parsed, err := hashtab.ParseConstraints(expr)
+		if err != nil {
+			return nil, err
+		}
+		constraints = parsed
+	}
+
+	var selected []*hashtab.Hashtab
+	for _, ht := range h.hasher.Hashtabs() {
+		if len(devices) > 0 && !slices.Contains(devices, ht.Device) {
+			continue
+		}
+		if constraints != nil {
+			v, err := hashtab.ParseOSVersion(ht.OSVersion)
+			if err != nil || !constraints.Check(v) {
+				continue
+			}
+		}
+		selected = append(selected, ht)
+	}
+
+	if len(selected) == 0 && (constraints != nil || len(devices) > 0) {
+		return nil, fmt.Errorf("no hashtabs loaded for version %q and devices %v", query.Get("version"), devices)
+	}
+
+	slices.SortStableFunc(selected, func(a, b *hashtab.Hashtab) int {
+		if c := hashtab.CompareVersions(b.OSVersion, a.OSVersion); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Device, b.Device)
+	})
+
+	return selected, nil
+}
+
+// relativeHashtabPath returns path relative to the hashtab directory, so
+// responses do not expose the server's filesystem layout.
+func (h *APIHandler) relativeHashtabPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if rel, err := filepath.Rel(h.hasher.HashtabDir(), path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return filepath.Base(path)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func newHashtabsTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServer(t, newNativeBackend(t, map[string][]string{
+		"3.22.0.64-rm2":          {"width"},
+		"3.24.0.149-rm2":         {"width", "statusBar"},
+		"vendor/3.24.0.149-rmpp": {"width"},
+	}, "vendor/3.24.0.149-rmpp"))
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestListHashtabs(t *testing.T) {
+	server := newHashtabsTestServer(t)
+
+	var all struct {
+		Hashtabs     []HashtabInfo `json:"hashtabs"`
+		Count        int           `json:"count"`
+		TotalEntries int           `json:"totalEntries"`
+	}
+	if status := getJSON(t, server.URL+"/api/hashtabs", &all); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	var got []string
+	for _, info := range all.Hashtabs {
+		got = append(got, fmt.Sprintf("%s %s %s %d", info.Path, info.Device, info.Format, info.Entries))
+		if len(info.SHA256) != 64 {
+			t.Errorf("%s: sha256 = %q", info.Name, info.SHA256)
+		}
+	}
+	// Newest version first, then by device; paths are relative.
+	want := []string{
+		"3.24.0.149-rm2 rm2 hashtab 2",
+		"vendor/3.24.0.149-rmpp rmpp hashlist 1",
+		"3.22.0.64-rm2 rm2 hashtab 1",
+	}
+	if !reflect.DeepEqual(got, want) || all.Count != 3 || all.TotalEntries != 4 {
+		t.Errorf("hashtabs = %q, count %d, total %d; want %q, 3, 4", got, all.Count, all.TotalEntries, want)
+	}
+
+	var filtered struct {
+		Hashtabs []HashtabInfo `json:"hashtabs"`
+	}
+	getJSON(t, server.URL+"/api/hashtabs?version=3.24&devices=rmpp", &filtered)
+	if len(filtered.Hashtabs) != 1 || filtered.Hashtabs[0].Device != "rmpp" {
+		t.Errorf("filtered = %+v, want only rmpp 3.24", filtered.Hashtabs)
+	}
+
+	if status := getJSON(t, server.URL+"/api/hashtabs?version=4.0", nil); status != http.StatusBadRequest {
+		t.Errorf("status for a filter matching nothing = %d, want 400", status)
+	}
+}
+
+func TestLookupHashtabs(t *testing.T) {
+	server := newHashtabsTestServer(t)
+
+	type lookup struct {
+		Hash     string         `json:"hash"`
+		String   string         `json:"string"`
+		Present  int            `json:"present"`
+		Hashtabs []HashtabMatch `json:"hashtabs"`
+	}
+
+	var byString lookup
+	getJSON(t, server.URL+"/api/hashtabs/lookup?string=statusBar", &byString)
+	statusBar := strconv.FormatUint(hashtab.DJB2Hash("statusBar"), 10)
+	if byString.Hash != statusBar || byString.String != "statusBar" || byString.Present != 1 {
+		t.Errorf("lookup = %+v, want statusBar's hash present once", byString)
+	}
+
+	// A hashlist has the hash but no string for it.
+	var byHash lookup
+	getJSON(t, server.URL+fmt.Sprintf("/api/hashtabs/lookup?hash=[[%d]]&version=3.24", hashtab.DJB2Hash("width")), &byHash)
+	want := []HashtabMatch{
+		{Name: "3.24.0.149-rm2", Version: "3.24.0.149", Device: "rm2", Present: true, String: "width"},
+		{Name: "3.24.0.149-rmpp", Version: "3.24.0.149", Device: "rmpp", Present: true},
+	}
+	if byHash.Present != 2 || !reflect.DeepEqual(byHash.Hashtabs, want) {
+		t.Errorf("lookup = %+v, want %+v", byHash.Hashtabs, want)
+	}
+
+	for _, query := range []string{"", "?hash=1&string=width", "?hash=width"} {
+		if status := getJSON(t, server.URL+"/api/hashtabs/lookup"+query, nil); status != http.StatusBadRequest {
+			t.Errorf("lookup%s = %d, want 400", query, status)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/hasher"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+// Migrate accepts QMD files hashed for fromVersion and starts a job that
+// rehashes them for the target version(s). Target versions and devices use the
+// same fields as Hash.
+func (h *APIHandler) Migrate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		logging.Error(logging.ComponentHandler, "Failed to parse multipart form: %v", err)
+		writeJSONError(w, http.StatusBadRequest, "Failed to parse form data")
+		return
+	}
+
+	if h.stillLoading(w, r.MultipartForm.Value) {
+		return
+	}
+
+	fromVersion := r.FormValue("fromVersion")
+	if fromVersion == "" {
+		writeJSONError(w, http.StatusBadRequest, "fromVersion is required")
+		return
+	}
+
+	if len(h.versionDevices(fromVersion)) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("version %s not available", fromVersion))
+		return
+	}
+
+	versions, err := h.resolveVersions(r.MultipartForm.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	devices := parseListValues(r.MultipartForm.Value["devices"])
+	if err := h.validateDevices(versions, devices); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	verify, _ := strconv.ParseBool(r.FormValue("verify"))
+
+	up, ok := h.receiveUploads(w, r)
+	if !ok {
+		return
+	}
+
+	logging.Info(logging.ComponentHandler, "Received %d QMD file(s) for migration from %s to %s", len(up.qmdFiles), fromVersion, strings.Join(versions, ", "))
+
+	h.startJob(w, "migrate", up, func(ctx context.Context, jobID string) {
+		h.processHashJob(ctx, jobID, fromVersion, versions, devices, verify, up)
+	})
+}
+
+// migrator unhashes files against a source version and checks which of their
+// identifiers the target GCD no longer has.
+type migrator struct {
+	hasher      hasher.Hasher
+	fromVersion string
+	source      *hashtab.Resolver
+	target      *hashtab.Hashtab
+}
+
+func (h *APIHandler) newMigrator(fromVersion, targetGCDPath string) (*migrator, error) {
+	target, err := hashtab.Load(targetGCDPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load target GCD hashtab: %w", err)
+	}
+
+	return &migrator{
+		hasher:      h.hasher,
+		fromVersion: fromVersion,
+		source:      h.hasher.Resolver(fromVersion),
+		target:      target,
+	}, nil
+}
+
+// unhash writes the unhashed form of inputPath to outputPath and records on
+// result the hashes the source version could not resolve and the identifiers
+// missing from the target.
+func (m *migrator) unhash(inputPath, outputPath string, result *jobs.FileResult) error {
+	content, err := os.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	out, unresolved := m.hasher.Unhash(content, m.fromVersion)
+
+	if err := os.WriteFile(outputPath, out, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	for _, hash := range unresolved {
+		result.Unresolved = append(result.Unresolved, strconv.FormatUint(hash, 10))
+	}
+
+	missing := make(map[string]bool)
+	for _, hash := range qmd.HashedRefs(content) {
+		if m.target.Has(hash) {
+			continue
+		}
+		if str, ok := m.source.Lookup(hash); ok {
+			missing[str] = true
+		} else {
+			missing[qmd.FormatHashed(hash)] = true
+		}
+	}
+	for id := range missing {
+		result.Missing = append(result.Missing, id)
+	}
+	sort.Strings(result.Missing)
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/hasher"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// newNativeBackend returns the native backend over hashtabs written from
+// tables, keyed by path relative to the hashtab directory. The tables named
+// in hashlists are written as hashlists.
+func newNativeBackend(t *testing.T, tables map[string][]string, hashlists ...string) hasher.Hasher {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, ids := range tables {
+		entries := make(map[uint64]string, len(ids))
+		for _, id := range ids {
+			entries[hashtab.DJB2Hash(id)] = id
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		save := hashtab.Save
+		if slices.Contains(hashlists, name) {
+			save = hashtab.SaveHashlist
+		}
+		if err := save(path, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashtabs, err := hashtab.NewService(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashtabs.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+	gcds, err := gcdcache.NewService(t.TempDir(), hashtabs, 1, gcdcache.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher.NewNative(hashtabs, gcds)
+}
+
+func TestMigrateJob(t *testing.T) {
+	server := newTestServer(t, newNativeBackend(t, map[string][]string{
+		"3.22.0.64-rm2":  {"statusBar", "width", "batteryIcon"},
+		"3.24.0.149-rm2": {"statusBar", "width"},
+	}))
+	h := func(id string) string { return fmt.Sprintf("[[%d]]", hashtab.DJB2Hash(id)) }
+
+	resp := server.postFiles(t, "/api/migrate", map[string]string{"fromVersion": "3.22.0.64", "version": "3.24.0.149"}, map[string]string{
+		"a.qmd": "AFFECT " + h("statusBar") + " { " + h("width") + ": 1; " + h("batteryIcon") + ": 2; " + "[[42]]: 3 }",
+	})
+	jobID := decodeJobID(t, resp)
+	job := server.waitForJob(t, jobID)
+
+	if job.Status != "success" || job.Type != "migrate" || len(job.Files) != 1 {
+		t.Fatalf("job = %s %s %+v, want a successful migrate job with one file", job.Status, job.Type, job.Files)
+	}
+	f := job.Files[0]
+	if !reflect.DeepEqual(f.Missing, []string{"[[42]]", "batteryIcon"}) {
+		t.Errorf("missing = %v, want the hash 3.22 cannot resolve and batteryIcon", f.Missing)
+	}
+	if !reflect.DeepEqual(f.Unresolved, []string{"42"}) {
+		t.Errorf("unresolved = %v, want [42]", f.Unresolved)
+	}
+
+	dl, err := http.Get(server.URL + "/api/download/" + jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Body.Close()
+	content, _ := io.ReadAll(dl.Body)
+	// Identifiers 3.24 has are hashed again; batteryIcon is left readable.
+	if want := "AFFECT " + h("statusBar") + " { " + h("width") + ": 1; batteryIcon: 2; [[42]]: 3 }"; string(content) != want {
+		t.Errorf("download = %q, want %q", content, want)
+	}
+}
+
+func TestMigrateRejectsUnknownSource(t *testing.T) {
+	server := newTestServer(t, newFakeHasher())
+
+	for _, from := range []string{"", "9.9"} {
+		resp := server.postFiles(t, "/api/migrate", map[string]string{"fromVersion": from, "version": "3.24.0.149"}, map[string]string{"a.qmd": "[[1]]"})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("fromVersion %q: status = %d, want 400", from, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Ready reports whether the server can take jobs: the hashtabs have been
+// loaded, at least one version is available, and the startup GCDs have been
+// generated. It answers 503 until then. Hashtab files that were rejected are
+// listed with the reason either way.
+func (h *APIHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	versions := h.hasher.Versions()
+	ready := h.hasher.Loaded() && h.hasher.GCDsReady() && len(versions) > 0
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":    ready,
+		"versions": len(versions),
+		"loading":  h.loadingVersions(versions),
+		"errors":   h.loadErrors(),
+	})
+}
+
+// loadErrors returns the hashtab load errors keyed by path relative to the
+// hashtab directory. The endpoint is unauthenticated, so the directory is
+// also stripped from the messages, which name manifests and files by path.
+func (h *APIHandler) loadErrors() map[string]string {
+	dir := filepath.Clean(h.hasher.HashtabDir()) + string(filepath.Separator)
+	errs := make(map[string]string)
+	for path, msg := range h.hasher.LoadErrors() {
+		errs[h.relativeHashtabPath(path)] = strings.ReplaceAll(msg, dir, "")
+	}
+	return errs
+}
+
+// stillLoading answers 503 and returns true while hashtabs a request needs
+// are being loaded at startup. values are the request's form or query values:
+// the versions named by version, versions and fromVersion, and those matching
+// versionRange, are needed. A nil values needs every version.
+func (h *APIHandler) stillLoading(w http.ResponseWriter, values map[string][]string) bool {
+	if h.hasher.Loaded() {
+		return false
+	}
+
+	loading := h.hasher.LoadingVersions()
+	// Before the first scan is done no version is known to be loading yet.
+	if values != nil && len(loading) > 0 && !needsAny(values, loading) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", "5")
+	writeJSONError(w, http.StatusServiceUnavailable, "Hashtables are still loading, try again shortly")
+	return true
+}
+
+// needsAny reports whether values name or match any of versions.
+func needsAny(values map[string][]string, versions []string) bool {
+	var named []string
+	for _, key := range []string{"version", "versions", "fromVersion"} {
+		named = append(named, parseListValues(values[key])...)
+	}
+
+	for _, v := range versions {
+		if slices.Contains(named, v) {
+			return true
+		}
+		if ranges := values["versionRange"]; len(ranges) > 0 && ranges[0] != "" && versionInRange(v, ranges[0]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+// Unhash accepts hashed QMD files and a version, and starts a job that
+// replaces each hashed identifier with its string from that version's device
+// hashtabs.
+func (h *APIHandler) Unhash(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		logging.Error(logging.ComponentHandler, "Failed to parse multipart form: %v", err)
+		writeJSONError(w, http.StatusBadRequest, "Failed to parse form data")
+		return
+	}
+
+	if h.stillLoading(w, r.MultipartForm.Value) {
+		return
+	}
+
+	version := r.FormValue("version")
+	if version == "" {
+		writeJSONError(w, http.StatusBadRequest, "version is required")
+		return
+	}
+
+	if len(h.versionDevices(version)) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("version %s not available", version))
+		return
+	}
+
+	up, ok := h.receiveUploads(w, r)
+	if !ok {
+		return
+	}
+
+	logging.Info(logging.ComponentHandler, "Received %d QMD file(s) for unhashing with version %s", len(up.qmdFiles), version)
+
+	h.startJob(w, "unhash", up, func(ctx context.Context, jobID string) {
+		h.processUnhashJob(ctx, jobID, version, up)
+	})
+}
+
+func (h *APIHandler) processUnhashJob(ctx context.Context, jobID, version string, up *upload) {
+	defer os.RemoveAll(up.inputDir)
+
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
+		return
+	}
+
+	h.jobStore.UpdateWithOperation(jobID, "running", "Unhashing files", nil, "unhashing")
+
+	h.jobStore.SetTarget(jobID, []string{version}, h.versionDevices(version), nil)
+
+	results := make([]jobs.FileResult, 0, len(up.qmdFiles))
+	successCount := 0
+
+	for i, inputPath := range up.qmdFiles {
+		if h.jobInterrupted(ctx, jobID, up.outputDir) {
+			return
+		}
+
+		relPath := up.relPaths[i]
+		result := jobs.FileResult{
+			Name: relPath,
+			Path: relPath,
+		}
+
+		unresolved, err := h.unhashFile(inputPath, filepath.Join(up.outputDir, relPath), version)
+		if err != nil {
+			logging.Error(logging.ComponentHandler, "Failed to unhash file %s: %v", relPath, err)
+			result.Status = "error"
+			result.Error = fmt.Sprintf("Unhashing failed: %v", err)
+		} else {
+			result.Status = "success"
+			for _, hash := range unresolved {
+				result.Unresolved = append(result.Unresolved, strconv.FormatUint(hash, 10))
+			}
+			successCount++
+		}
+		results = append(results, result)
+
+		progress := int(float64(i+1) / float64(len(up.qmdFiles)) * 100)
+		h.jobStore.UpdateProgress(jobID, progress)
+	}
+
+	h.jobStore.SetFiles(jobID, results)
+
+	if h.jobInterrupted(ctx, jobID, up.outputDir) {
+		return
+	}
+
+	if successCount == 0 {
+		h.jobStore.Update(jobID, "error", "All files failed to unhash", nil)
+		os.RemoveAll(up.outputDir)
+		return
+	}
+
+	logging.Info(logging.ComponentHandler, "Unhashing complete for job %s: %d/%d files successful", jobID, successCount, len(up.qmdFiles))
+	h.jobStore.Update(jobID, "success", fmt.Sprintf("Unhashed %d file(s)", successCount), nil)
+}
+
+func (h *APIHandler) unhashFile(inputPath, outputPath, version string) ([]uint64, error) {
+	content, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	out, unresolved := h.hasher.Unhash(content, version)
+
+	if err := os.WriteFile(outputPath, out, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return unresolved, nil
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+// upload is a set of QMD files saved from a multipart request, along with the
+// output directory their processed versions are written to.
+type upload struct {
+	inputDir  string
+	outputDir string
+	qmdFiles  []string
+	relPaths  []string
+}
+
+func (u *upload) remove() {
+	os.RemoveAll(u.inputDir)
+	os.RemoveAll(u.outputDir)
+}
+
+// receiveUploads saves the .qmd files of an already parsed multipart form into
+// a fresh input directory. On failure it writes the error response itself and
+// returns false.
+func (h *APIHandler) receiveUploads(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	var fileHeaders []*multipart.FileHeader
+	var filePaths []string
+
+	if files := r.MultipartForm.File["files"]; len(files) > 0 {
+		fileHeaders = files
+		filePaths = r.MultipartForm.Value["paths"]
+	} else {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			logging.Error(logging.ComponentHandler, "No files uploaded: %v", err)
+			writeJSONError(w, http.StatusBadRequest, "No file uploaded or invalid form data")
+			return nil, false
+		}
+		file.Close()
+		fileHeaders = []*multipart.FileHeader{header}
+		filePaths = []string{header.Filename}
+	}
+
+	inputDir, err := h.workdirs.CreateInputDir()
+	if err != nil {
+		logging.Error(logging.ComponentHandler, "Failed to create input temp directory: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create temp directory")
+		return nil, false
+	}
+
+	outputDir, err := h.workdirs.CreateOutputDir()
+	if err != nil {
+		os.RemoveAll(inputDir)
+		logging.Error(logging.ComponentHandler, "Failed to create output temp directory: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create temp directory")
+		return nil, false
+	}
+
+	qmdFiles := make([]string, 0, len(fileHeaders))
+	relPaths := make([]string, 0, len(fileHeaders))
+
+	for i, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			logging.Error(logging.ComponentHandler, "Failed to open uploaded file %s: %v", fileHeader.Filename, err)
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to open file %s", fileHeader.Filename))
+			return nil, false
+		}
+
+		var relativePath string
+		if i < len(filePaths) && filePaths[i] != "" {
+			relativePath = filepath.Clean(filePaths[i])
+		} else {
+			relativePath = filepath.Clean(fileHeader.Filename)
+		}
+
+		if !strings.HasSuffix(strings.ToLower(relativePath), ".qmd") {
+			file.Close()
+			continue
+		}
+
+		inputPath := filepath.Join(inputDir, relativePath)
+		outputPath := filepath.Join(outputDir, relativePath)
+
+		cleanInputDir := filepath.Clean(inputDir) + string(os.PathSeparator)
+		cleanInputPath := filepath.Clean(inputPath)
+		if !strings.HasPrefix(cleanInputPath+string(os.PathSeparator), cleanInputDir) {
+			file.Close()
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			logging.Warn(logging.ComponentHandler, "Path traversal attempt detected: %s", relativePath)
+			writeJSONError(w, http.StatusBadRequest, "Invalid file path")
+			return nil, false
+		}
+
+		if err := os.MkdirAll(filepath.Dir(inputPath), 0755); err != nil {
+			file.Close()
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create directory for file %s", fileHeader.Filename))
+			return nil, false
+		}
+
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			file.Close()
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create output directory for file %s", fileHeader.Filename))
+			return nil, false
+		}
+
+		inputFile, err := os.Create(inputPath)
+		if err != nil {
+			file.Close()
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to save file %s", fileHeader.Filename))
+			return nil, false
+		}
+
+		bytesWritten, err := io.Copy(inputFile, file)
+		file.Close()
+		inputFile.Close()
+
+		if err != nil {
+			os.RemoveAll(inputDir)
+			os.RemoveAll(outputDir)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to save file %s", fileHeader.Filename))
+			return nil, false
+		}
+
+		if bytesWritten == 0 {
+			logging.Warn(logging.ComponentHandler, "Skipping empty file: %s", fileHeader.Filename)
+			continue
+		}
+
+		qmdFiles = append(qmdFiles, inputPath)
+		relPaths = append(relPaths, relativePath)
+	}
+
+	if len(qmdFiles) == 0 {
+		os.RemoveAll(inputDir)
+		os.RemoveAll(outputDir)
+		writeJSONError(w, http.StatusBadRequest, "No .qmd files uploaded")
+		return nil, false
+	}
+
+	return &upload{
+		inputDir:  inputDir,
+		outputDir: outputDir,
+		qmdFiles:  qmdFiles,
+		relPaths:  relPaths,
+	}, true
+}
+
+// startJob creates a job for up, queues run for it and writes the job ID
+// response. run receives a context that ends when the job is cancelled or
+// times out.
+func (h *APIHandler) startJob(w http.ResponseWriter, jobType string, up *upload, run func(ctx context.Context, jobID string)) {
+	jobID := uuid.New().String()
+	h.jobStore.Create(jobID, jobType, len(up.qmdFiles))
+	h.jobStore.SetOutputDir(jobID, up.outputDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.jobStore.SetCancel(jobID, cancel)
+
+	err := h.jobQueue.Enqueue(ctx, jobID, func(ctx context.Context) {
+		defer cancel()
+		ctx, cancelTimeout := context.WithTimeout(ctx, h.jobTimeout)
+		defer cancelTimeout()
+		run(ctx, jobID)
+	})
+	if err != nil {
+		cancel()
+		h.jobStore.Cleanup(jobID)
+		up.remove()
+		if errors.Is(err, jobs.ErrQueueFull) {
+			logging.Warn(logging.ComponentHandler, "Rejecting %s request: job queue is full", jobType)
+			writeJSONError(w, http.StatusTooManyRequests, "Too many jobs queued, try again later")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "Failed to queue job")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"jobId": jobID,
+	})
+}
@@ -42,7 +42,7 @@ func StatusWSHandler(jobStore *jobs.Store) http.HandlerFunc {
 				return
 			}
 
-			if job.Status == "success" || job.Status == "error" {
+			if jobs.IsTerminal(job.Status) {
 				return
 			}
 		}
@@ -0,0 +1,311 @@
+package hasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/qmldiff"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// QMLDiffRunner runs qmldiff; *qmldiff.Service implements it.
+type QMLDiffRunner interface {
+	HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error
+	HashDiffsBatch(ctx context.Context, hashtabPath string, qmdPaths []string) error
+	Verify(ctx context.Context, hashtabPath, qmdPath string) error
+	// Capabilities returns what the last probe found, or nil if none ran.
+	Capabilities() *qmldiff.Capabilities
+}
+
+// Exec hashes by running the qmldiff binary.
+type Exec struct {
+	base
+	qmldiff   QMLDiffRunner
+	batchSize int
+	// batchUnsupported is set once qmldiff is seen to hash only the first
+	// file of a batch, and batchSupported once it is seen to hash a later one.
+	batchUnsupported atomic.Bool
+	batchSupported   atomic.Bool
+}
+
+// NewExec returns a backend that hashes up to batchSize files per qmldiff
+// process. A batchSize below 2 runs one process per file.
+func NewExec(qmldiffService QMLDiffRunner, batchSize int, hashtabService *hashtab.Service, gcdCache *gcdcache.Service) *Exec {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &Exec{
+		base:      base{hashtabService: hashtabService, gcdCache: gcdCache},
+		qmldiff:   qmldiffService,
+		batchSize: batchSize,
+	}
+}
+
+func (e *Exec) Name() string {
+	return "qmldiff"
+}
+
+func (e *Exec) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	return e.qmldiff.HashDiffs(ctx, hashtabPath, qmdPath)
+}
+
+// HashFiles runs qmldiff on batches of files, reporting progress after each
+// batch. See hashBatch for how failures are attributed.
+func (e *Exec) HashFiles(ctx context.Context, hashtabPath string, qmdPaths []string, progress func(done int)) []error {
+	errs := make([]error, len(qmdPaths))
+
+	for start := 0; start < len(qmdPaths); start += e.batchSize {
+		end := start + e.batchSize
+		if end > len(qmdPaths) {
+			end = len(qmdPaths)
+		}
+
+		e.hashBatch(ctx, hashtabPath, qmdPaths[start:end], errs[start:end])
+		if err := ctx.Err(); err != nil {
+			fillErrors(errs[start:], fmt.Errorf("hash-diffs interrupted: %w", err))
+			return errs
+		}
+		progress(end)
+	}
+
+	return errs
+}
+
+// hashBatch hashes paths with one qmldiff process and sets errs for the files
+// that fail. If the process fails, every file is restored from the contents
+// it had beforehand; the files named in its diagnostics are retried alone and
+// the rest as a new batch. When no file is named, each is retried alone.
+//
+// A qmldiff that only hashes the first file it is given would otherwise go
+// unnoticed, so files left unchanged by a successful batch are retried alone
+// too. If that changes them, batching is turned off for good; once a batch
+// has hashed a file after its first, unchanged files are no longer retried.
+func (e *Exec) hashBatch(ctx context.Context, hashtabPath string, paths []string, errs []error) {
+	if len(paths) == 1 || e.batchUnsupported.Load() {
+		e.hashEach(ctx, hashtabPath, paths, errs, nil)
+		return
+	}
+
+	originals, err := readAll(paths)
+	if err != nil {
+		fillErrors(errs, err)
+		return
+	}
+
+	err = e.qmldiff.HashDiffsBatch(ctx, hashtabPath, paths)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		if !e.batchSupported.Load() {
+			e.retryUnchanged(ctx, hashtabPath, paths, originals, errs)
+		}
+		return
+	}
+
+	if err := restoreAll(paths, originals); err != nil {
+		fillErrors(errs, err)
+		return
+	}
+
+	named := failedFiles(err, paths)
+	if len(named) == 0 {
+		logging.Debug(logging.ComponentQMLDiff, "Batch of %d file(s) failed, retrying individually: %v", len(paths), err)
+		e.hashEach(ctx, hashtabPath, paths, errs, nil)
+		return
+	}
+
+	logging.Debug(logging.ComponentQMLDiff, "Batch of %d file(s) failed on %d named file(s), retrying them individually: %v", len(paths), len(named), err)
+	e.hashEach(ctx, hashtabPath, paths, errs, named)
+	if ctx.Err() != nil {
+		return
+	}
+
+	var rest []string
+	var restIdx []int
+	for i, path := range paths {
+		if !named[i] {
+			rest = append(rest, path)
+			restIdx = append(restIdx, i)
+		}
+	}
+	if len(rest) == 0 {
+		return
+	}
+	restErrs := make([]error, len(rest))
+	e.hashBatch(ctx, hashtabPath, rest, restErrs)
+	for k, i := range restIdx {
+		errs[i] = restErrs[k]
+	}
+}
+
+// hashEach runs qmldiff once per file, on every file or, if only is non-nil,
+// on the files at the indexes it holds.
+func (e *Exec) hashEach(ctx context.Context, hashtabPath string, paths []string, errs []error, only map[int]bool) {
+	for i, path := range paths {
+		if only != nil && !only[i] {
+			continue
+		}
+		errs[i] = e.qmldiff.HashDiffs(ctx, hashtabPath, path)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// retryUnchanged runs qmldiff alone on every file a successful batch left as
+// it was, and turns batching off if that hashes one of them. If the batch
+// changed a file after its first, batching works and nothing is retried.
+func (e *Exec) retryUnchanged(ctx context.Context, hashtabPath string, paths []string, originals [][]byte, errs []error) {
+	var unchanged []int
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to read hashed QMD file: %w", err)
+			continue
+		}
+		if bytes.Equal(data, originals[i]) {
+			unchanged = append(unchanged, i)
+		} else if i > 0 {
+			e.batchSupported.Store(true)
+		}
+	}
+	if e.batchSupported.Load() {
+		return
+	}
+
+	for _, i := range unchanged {
+		errs[i] = e.qmldiff.HashDiffs(ctx, hashtabPath, paths[i])
+		if ctx.Err() != nil {
+			return
+		}
+		if errs[i] == nil && !e.batchUnsupported.Load() {
+			if data, err := os.ReadFile(paths[i]); err == nil && !bytes.Equal(data, originals[i]) {
+				logging.Warn(logging.ComponentQMLDiff, "qmldiff hash-diffs ignored files after the first in a batch; hashing one file per process from now on")
+				e.batchUnsupported.Store(true)
+			}
+		}
+	}
+}
+
+// failedFiles returns the indexes of the paths that the diagnostics of a
+// qmldiff error name.
+func failedFiles(err error, paths []string) map[int]bool {
+	var qerr *qmldiff.Error
+	if !errors.As(err, &qerr) {
+		return nil
+	}
+
+	index := make(map[string]int, len(paths))
+	for i, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			index[abs] = i
+		}
+	}
+
+	named := make(map[int]bool)
+	for _, d := range qerr.Diagnostics {
+		if d.File == "" {
+			continue
+		}
+		if i, ok := index[filepath.Clean(d.File)]; ok {
+			named[i] = true
+		}
+	}
+	if len(named) == 0 {
+		return nil
+	}
+	return named
+}
+
+// Verify runs qmldiff verify against the hashtab of each target device when
+// the probed binary has that subcommand, and otherwise checks the hashes in
+// process like the native backend. A device fails if qmldiff rejects the file
+// for any of its hashtabs.
+func (e *Exec) Verify(ctx context.Context, path string, versions, devices []string) (*Verification, error) {
+	caps := e.qmldiff.Capabilities()
+	if caps == nil || !slices.Contains(caps.Subcommands, "verify") {
+		return e.base.Verify(ctx, path, versions, devices)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashed file: %w", err)
+	}
+
+	targets := e.targets(versions, devices)
+	v := &Verification{
+		Devices:  make(map[string]jobs.DeviceResult, len(targets)),
+		Unhashed: unhashed(content, targets),
+	}
+
+	for device, hashtabs := range targets {
+		result := jobs.DeviceResult{Passed: true}
+		for _, ht := range hashtabs {
+			err := e.qmldiff.Verify(ctx, ht.Path, path)
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("verify interrupted: %w", ctx.Err())
+			}
+			if err == nil {
+				continue
+			}
+			var qerr *qmldiff.Error
+			if !errors.As(err, &qerr) {
+				return nil, err
+			}
+			result.Passed = false
+			result.Error = qerr.Error()
+			for _, d := range qerr.Diagnostics {
+				if d.Token != "" && !slices.Contains(result.Missing, d.Token) {
+					result.Missing = append(result.Missing, d.Token)
+				}
+			}
+			break
+		}
+		v.Devices[device] = result
+		if !result.Passed {
+			v.Failed++
+		}
+	}
+
+	return v, nil
+}
+
+func readAll(paths []string) ([][]byte, error) {
+	contents := make([][]byte, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read QMD file: %w", err)
+		}
+		contents[i] = data
+	}
+	return contents, nil
+}
+
+func restoreAll(paths []string, contents [][]byte) error {
+	for i, path := range paths {
+		if err := os.WriteFile(path, contents[i], 0644); err != nil {
+			return fmt.Errorf("failed to restore QMD file after failed batch: %w", err)
+		}
+	}
+	return nil
+}
+
+// fillErrors sets err on every file that has no error yet.
+func fillErrors(errs []error, err error) {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = fmt.Errorf("not hashed: %w", err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package hasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/qmldiff"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// fakeQMLDiff hashes a file by replacing "width" with [[1]], and rejects
+// files that mention "unknownId" with a diagnostic naming the file. With
+// firstOnly set, a batch hashes only its first file, as a qmldiff without
+// multi-file support would.
+type fakeQMLDiff struct {
+	firstOnly bool
+	calls     [][]string
+
+	// caps is what Capabilities reports; verify rejects a file for every
+	// hashtab it lists, by file name.
+	caps   *qmldiff.Capabilities
+	reject map[string]bool
+}
+
+func (f *fakeQMLDiff) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	return f.HashDiffsBatch(ctx, hashtabPath, []string{qmdPath})
+}
+
+func (f *fakeQMLDiff) HashDiffsBatch(ctx context.Context, hashtabPath string, qmdPaths []string) error {
+	names := make([]string, len(qmdPaths))
+	for i, path := range qmdPaths {
+		names[i] = filepath.Base(path)
+	}
+	f.calls = append(f.calls, names)
+
+	if f.firstOnly {
+		qmdPaths = qmdPaths[:1]
+	}
+
+	var diags []qmldiff.Diagnostic
+	for _, path := range qmdPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte("unknownId")) {
+			diags = append(diags, qmldiff.Diagnostic{File: path, Severity: "error", Message: "unknown identifier 'unknownId'"})
+			continue
+		}
+		if err := os.WriteFile(path, bytes.ReplaceAll(data, []byte("width"), []byte("[[1]]")), 0644); err != nil {
+			return err
+		}
+	}
+	if len(diags) > 0 {
+		return &qmldiff.Error{Command: "hash-diffs", Err: errors.New("exit status 1"), Diagnostics: diags}
+	}
+	return nil
+}
+
+func (f *fakeQMLDiff) Verify(ctx context.Context, hashtabPath, qmdPath string) error {
+	if f.reject[filepath.Base(hashtabPath)] {
+		return &qmldiff.Error{
+			Command:     "verify",
+			Err:         errors.New("exit status 1"),
+			Diagnostics: []qmldiff.Diagnostic{{Severity: "error", Message: "hash '[[42]]' not found", Token: "[[42]]"}},
+		}
+	}
+	return nil
+}
+
+func (f *fakeQMLDiff) Capabilities() *qmldiff.Capabilities {
+	return f.caps
+}
+
+func writeQMD(t *testing.T, dir string, files map[string]string, order []string) []string {
+	t.Helper()
+
+	paths := make([]string, len(order))
+	for i, name := range order {
+		paths[i] = filepath.Join(dir, name)
+		if err := os.WriteFile(paths[i], []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestExecRetriesNamedFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeQMD(t, dir, map[string]string{
+		"a.qmd": "width",
+		"b.qmd": "unknownId",
+		"c.qmd": "width",
+		"d.qmd": "width",
+	}, []string{"a.qmd", "b.qmd", "c.qmd", "d.qmd"})
+
+	runner := &fakeQMLDiff{}
+	e := NewExec(runner, 4, nil, nil)
+	errs := e.HashFiles(context.Background(), "gcd", paths, func(int) {})
+
+	for i, err := range errs {
+		if (err != nil) != (i == 1) {
+			t.Errorf("%s: error = %v", filepath.Base(paths[i]), err)
+		}
+	}
+	want := [][]string{{"a.qmd", "b.qmd", "c.qmd", "d.qmd"}, {"b.qmd"}, {"a.qmd", "c.qmd", "d.qmd"}}
+	if !reflect.DeepEqual(runner.calls, want) {
+		t.Errorf("qmldiff runs = %v, want %v", runner.calls, want)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if data, _ := os.ReadFile(paths[i]); string(data) != "[[1]]" {
+			t.Errorf("%s = %q, want it hashed once", filepath.Base(paths[i]), data)
+		}
+	}
+}
+
+func TestExecRetriesUnnamedFailureIndividually(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeQMD(t, dir, map[string]string{"a.qmd": "width", "b.qmd": "width"}, []string{"a.qmd", "b.qmd"})
+
+	runner := &unnamedFailure{}
+	e := NewExec(runner, 2, nil, nil)
+	errs := e.HashFiles(context.Background(), "gcd", paths, func(int) {})
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("errors = %v", errs)
+	}
+	if runner.batches != 1 || runner.singles != 2 {
+		t.Errorf("runs = %d batch(es), %d single(s), want 1 and 2", runner.batches, runner.singles)
+	}
+}
+
+// unnamedFailure fails every batch without saying which file was at fault.
+type unnamedFailure struct {
+	fakeQMLDiff
+	batches, singles int
+}
+
+func (u *unnamedFailure) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	u.singles++
+	return u.fakeQMLDiff.HashDiffsBatch(ctx, hashtabPath, []string{qmdPath})
+}
+
+func (u *unnamedFailure) HashDiffsBatch(ctx context.Context, hashtabPath string, qmdPaths []string) error {
+	u.batches++
+	for _, path := range qmdPaths {
+		os.WriteFile(path, []byte("partial"), 0644)
+	}
+	return &qmldiff.Error{Command: "hash-diffs", Err: errors.New("exit status 101")}
+}
+
+func TestExecDetectsIgnoredBatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeQMD(t, dir, map[string]string{
+		"a.qmd": "width",
+		"b.qmd": "width",
+		"c.qmd": "nothing to hash",
+		"d.qmd": "width",
+	}, []string{"a.qmd", "b.qmd", "c.qmd", "d.qmd"})
+
+	runner := &fakeQMLDiff{firstOnly: true}
+	e := NewExec(runner, 2, nil, nil)
+	errs := e.HashFiles(context.Background(), "gcd", paths, func(int) {})
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(paths[i]), err)
+		}
+	}
+	for _, i := range []int{0, 1, 3} {
+		if data, _ := os.ReadFile(paths[i]); string(data) != "[[1]]" {
+			t.Errorf("%s = %q, want it hashed", filepath.Base(paths[i]), data)
+		}
+	}
+	if !e.batchUnsupported.Load() {
+		t.Error("batching still enabled after qmldiff ignored a file")
+	}
+
+	var runs []string
+	for _, call := range runner.calls {
+		runs = append(runs, strings.Join(call, "+"))
+	}
+	want := []string{"a.qmd+b.qmd", "b.qmd", "c.qmd", "d.qmd"}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("qmldiff runs = %v, want %v", runs, want)
+	}
+}
+
+func TestExecStopsRetryingOnceBatchingWorks(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeQMD(t, dir, map[string]string{
+		"a.qmd": "nothing to hash",
+		"b.qmd": "width",
+		"c.qmd": "nothing to hash",
+		"d.qmd": "nothing to hash",
+	}, []string{"a.qmd", "b.qmd", "c.qmd", "d.qmd"})
+
+	runner := &fakeQMLDiff{}
+	e := NewExec(runner, 2, nil, nil)
+	errs := e.HashFiles(context.Background(), "gcd", paths, func(int) {})
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(paths[i]), err)
+		}
+	}
+	if !e.batchSupported.Load() || e.batchUnsupported.Load() {
+		t.Errorf("batchSupported = %t, batchUnsupported = %t after b.qmd was hashed in a batch", e.batchSupported.Load(), e.batchUnsupported.Load())
+	}
+
+	// The first batch hashed b.qmd, so neither a.qmd nor the files of the
+	// second batch are retried alone.
+	var runs []string
+	for _, call := range runner.calls {
+		runs = append(runs, strings.Join(call, "+"))
+	}
+	want := []string{"a.qmd+b.qmd", "c.qmd+d.qmd"}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("qmldiff runs = %v, want %v", runs, want)
+	}
+}
+
+func TestExecVerifyRunsQMLDiff(t *testing.T) {
+	dir := t.TempDir()
+	h := hashtab.DJB2Hash
+	for name, entries := range map[string]map[uint64]string{
+		"3.24-rm2":  {h("width"): "width", h("battery"): "battery"},
+		"3.24-rmpp": {h("width"): "width"},
+	} {
+		if err := hashtab.Save(filepath.Join(dir, name), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashtabs, err := hashtab.NewService(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashtabs.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	qmdPath := filepath.Join(t.TempDir(), "a.qmd")
+	if err := os.WriteFile(qmdPath, []byte("[[42]]: battery; id: custom"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &fakeQMLDiff{
+		caps:   &qmldiff.Capabilities{Subcommands: []string{"hash-diffs", "verify"}},
+		reject: map[string]bool{"3.24-rmpp": true},
+	}
+	e := NewExec(runner, 1, hashtabs, nil)
+
+	v, err := e.Verify(context.Background(), qmdPath, []string{"3.24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]jobs.DeviceResult{
+		"rm2":  {Passed: true},
+		"rmpp": {Missing: []string{"[[42]]"}, Error: "verify failed: exit status 1"},
+	}
+	if v.Failed != 1 || !reflect.DeepEqual(v.Devices, want) {
+		t.Errorf("Verify = %d failed, %+v, want 1 failed, %+v", v.Failed, v.Devices, want)
+	}
+	if want := []string{"battery"}; !reflect.DeepEqual(v.Unhashed, want) {
+		t.Errorf("Unhashed = %v, want %v", v.Unhashed, want)
+	}
+}
@@ -0,0 +1,273 @@
+// Package hasher abstracts the operations the API needs to turn QMD files
+// into hashed QMD and back, so the qmldiff binary can be swapped for an
+// in-process implementation.
+package hasher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+type Hasher interface {
+	// Name identifies the backend, e.g. in logs and /api/version.
+	Name() string
+	// HashDiffs hashes the QMD file at qmdPath in place using the hashtab at
+	// hashtabPath.
+	HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error
+	// HashFiles hashes every file in qmdPaths in place and returns one error
+	// per file, nil for those that succeeded. An *UnresolvedWarning is not a
+	// failure: the file was hashed, but kept tokens the hashtab lacks. progress
+	// is called with the number of files done so far.
+	HashFiles(ctx context.Context, hashtabPath string, qmdPaths []string, progress func(done int)) []error
+	// Loaded reports whether the device hashtabs have been loaded, so that
+	// versions can be validated.
+	Loaded() bool
+	// LoadingVersions returns the versions whose hashtabs are still being
+	// loaded at startup.
+	LoadingVersions() []string
+	// GCDsReady reports whether the default GCD of every version has been
+	// generated at startup.
+	GCDsReady() bool
+	// Generating reports whether the default GCD of version is still waiting
+	// to be generated at startup.
+	Generating(version string) bool
+	// LoadErrors returns, by path, why each hashtab file that failed to load
+	// was rejected.
+	LoadErrors() map[string]string
+	// Hashtabs returns the loaded device hashtabs.
+	Hashtabs() []*hashtab.Hashtab
+	// HashtabDir returns the directory the device hashtabs are loaded from.
+	HashtabDir() string
+	// Versions returns the loaded versions and their devices, newest first.
+	Versions() []hashtab.VersionInfo
+	// VersionsMatching returns the loaded versions satisfying a constraint
+	// expression such as "3.22-3.24", newest first.
+	VersionsMatching(expr string) ([]hashtab.VersionInfo, error)
+	// CheckLimits reports whether a GCD for versions and devices may be built.
+	CheckLimits(versions, devices []string) error
+	// BuildGCD returns the GCD hashtab valid on every listed version and
+	// device, building it if needed. Its file is kept until ReleaseGCD.
+	BuildGCD(versions, devices []string) (*gcdcache.GCDHashtab, error)
+	// ReleaseGCD marks a GCD from BuildGCD as no longer in use.
+	ReleaseGCD(gcd *gcdcache.GCDHashtab)
+	// DroppedIdentifiers returns the identifiers that the GCD of versions and
+	// devices lacks because some of its device hashtabs do.
+	DroppedIdentifiers(versions, devices, identifiers []string) ([]gcdcache.DroppedIdentifier, error)
+	// Verify checks the hashed file at path against the hashtab of each target
+	// device of versions, and looks for identifiers left unhashed in it.
+	Verify(ctx context.Context, path string, versions, devices []string) (*Verification, error)
+	// Compatibility reports, per version and device, which of hashes the
+	// loaded hashtabs lack, after reloading hashtabs that changed.
+	Compatibility(hashes []uint64) []hashtab.VersionCompatibility
+	// Resolver returns the strings of the device hashtabs of version by hash.
+	Resolver(version string) *hashtab.Resolver
+	// Unhash replaces the hashes in content with their strings from the device
+	// hashtabs of version and returns the hashes it could not resolve.
+	Unhash(content []byte, version string) ([]byte, []uint64)
+}
+
+// New returns the backend called name: "qmldiff" runs the qmldiff binary
+// through qmldiffService, hashing up to batchSize files per process, and
+// "native" hashes in process.
+func New(name string, qmldiffService QMLDiffRunner, batchSize int, hashtabService *hashtab.Service, gcdCache *gcdcache.Service) (Hasher, error) {
+	switch name {
+	case "qmldiff":
+		return NewExec(qmldiffService, batchSize, hashtabService, gcdCache), nil
+	case "native":
+		return NewNative(hashtabService, gcdCache), nil
+	default:
+		return nil, fmt.Errorf("unknown hash backend %q", name)
+	}
+}
+
+// base implements the operations that both backends do in process.
+type base struct {
+	hashtabService *hashtab.Service
+	gcdCache       *gcdcache.Service
+}
+
+// UnresolvedWarning is returned for a file that was hashed but kept tokens
+// the hashtab has no hash for. Those are mostly the file's own names,
+// comments and UI strings, which stay in plain form, so the file's output is
+// still valid.
+type UnresolvedWarning struct {
+	Identifiers []string
+}
+
+// maxListedIdentifiers bounds how many identifiers Error names.
+const maxListedIdentifiers = 10
+
+func (w *UnresolvedWarning) Error() string {
+	listed := w.Identifiers
+	more := ""
+	if len(listed) > maxListedIdentifiers {
+		more = fmt.Sprintf(" and %d more", len(listed)-maxListedIdentifiers)
+		listed = listed[:maxListedIdentifiers]
+	}
+	return fmt.Sprintf("%d identifier(s) not in hashtab left unhashed: %s%s", len(w.Identifiers), strings.Join(listed, ", "), more)
+}
+
+func (b *base) Loaded() bool {
+	return b.hashtabService.Loaded()
+}
+
+func (b *base) LoadingVersions() []string {
+	return b.hashtabService.LoadingVersions()
+}
+
+func (b *base) GCDsReady() bool {
+	return b.gcdCache.Ready()
+}
+
+func (b *base) Generating(version string) bool {
+	return b.gcdCache.Generating(version)
+}
+
+func (b *base) LoadErrors() map[string]string {
+	return b.hashtabService.LoadErrors()
+}
+
+func (b *base) Hashtabs() []*hashtab.Hashtab {
+	return b.hashtabService.GetHashtables()
+}
+
+func (b *base) HashtabDir() string {
+	return b.hashtabService.Dir()
+}
+
+func (b *base) Versions() []hashtab.VersionInfo {
+	return b.gcdCache.GetVersions()
+}
+
+func (b *base) VersionsMatching(expr string) ([]hashtab.VersionInfo, error) {
+	return b.gcdCache.GetVersionsMatching(expr)
+}
+
+func (b *base) CheckLimits(versions, devices []string) error {
+	return b.gcdCache.CheckLimits(versions, devices)
+}
+
+func (b *base) BuildGCD(versions, devices []string) (*gcdcache.GCDHashtab, error) {
+	return b.gcdCache.GetGCDHashtabForVersions(versions, devices)
+}
+
+func (b *base) ReleaseGCD(gcd *gcdcache.GCDHashtab) {
+	b.gcdCache.Release(gcd)
+}
+
+func (b *base) DroppedIdentifiers(versions, devices, identifiers []string) ([]gcdcache.DroppedIdentifier, error) {
+	return b.gcdCache.DroppedIdentifiers(versions, devices, identifiers)
+}
+
+// Verification is the outcome of verifying one hashed file.
+type Verification struct {
+	Devices map[string]jobs.DeviceResult
+	// Failed is the number of devices that did not pass.
+	Failed int
+	// Unhashed lists identifiers still in plain form in the file although a
+	// target device hashtab has them, so they should have been hashed.
+	Unhashed []string
+}
+
+// Verify checks that every hash in the file exists in the hashtab of each
+// target device.
+func (b *base) Verify(ctx context.Context, path string, versions, devices []string) (*Verification, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashed file: %w", err)
+	}
+
+	targets := b.targets(versions, devices)
+	v := &Verification{
+		Devices:  make(map[string]jobs.DeviceResult, len(targets)),
+		Unhashed: unhashed(content, targets),
+	}
+
+	refs := qmd.HashedRefs(content)
+	for device, hashtabs := range targets {
+		var missing []string
+		for _, hash := range refs {
+			for _, ht := range hashtabs {
+				if !ht.Has(hash) {
+					missing = append(missing, strconv.FormatUint(hash, 10))
+					break
+				}
+			}
+		}
+		v.Devices[device] = jobs.DeviceResult{
+			Passed:  len(missing) == 0,
+			Missing: missing,
+		}
+		if len(missing) > 0 {
+			v.Failed++
+		}
+	}
+
+	return v, nil
+}
+
+// targets returns the hashtabs of versions by device, limited to devices
+// unless that is empty.
+func (b *base) targets(versions, devices []string) map[string][]*hashtab.Hashtab {
+	wanted := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		wanted[d] = true
+	}
+
+	targets := make(map[string][]*hashtab.Hashtab)
+	for _, version := range versions {
+		for _, ht := range b.hashtabService.GetHashtabsForVersion(version) {
+			if len(wanted) == 0 || wanted[ht.Device] {
+				targets[ht.Device] = append(targets[ht.Device], ht)
+			}
+		}
+	}
+	return targets
+}
+
+// unhashed returns the plain identifiers in content that any of targets has
+// a hash for. Plain identifiers no hashtab knows, such as names a file
+// declares itself, are expected in hashed QMD and left out.
+func unhashed(content []byte, targets map[string][]*hashtab.Hashtab) []string {
+	var found []string
+	for _, id := range qmd.Unhashed(content) {
+		hash := hashtab.DJB2Hash(id)
+		if hash == hashtab.VersionHash {
+			continue
+		}
+	search:
+		for _, hashtabs := range targets {
+			for _, ht := range hashtabs {
+				if ht.Has(hash) {
+					found = append(found, id)
+					break search
+				}
+			}
+		}
+	}
+	return found
+}
+
+func (b *base) Compatibility(hashes []uint64) []hashtab.VersionCompatibility {
+	if _, err := b.hashtabService.CheckAndReload(); err != nil {
+		logging.Warn(logging.ComponentHashtab, "Failed to check hashtab reload: %v", err)
+	}
+	return b.hashtabService.CheckCompatibility(hashes)
+}
+
+func (b *base) Resolver(version string) *hashtab.Resolver {
+	return b.hashtabService.ResolverForVersion(version)
+}
+
+func (b *base) Unhash(content []byte, version string) ([]byte, []uint64) {
+	return qmd.Unhash(content, b.Resolver(version).Lookup)
+}
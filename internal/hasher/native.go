@@ -0,0 +1,124 @@
+package hasher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+// Native hashes QMD in process: every identifier and quoted string whose
+// DJB2 hash the hashtab contains is replaced with its hashed form. The rest
+// are left as they are and listed in an *UnresolvedWarning.
+type Native struct {
+	base
+	mu      sync.Mutex
+	loaded  map[string]loadedHashtab
+	useTick uint64
+}
+
+// maxLoaded is how many parsed hashtabs Native keeps; the least recently
+// used is dropped beyond that.
+const maxLoaded = 8
+
+type loadedHashtab struct {
+	modTime  time.Time
+	ht       *hashtab.Hashtab
+	lastUsed uint64
+}
+
+func NewNative(hashtabService *hashtab.Service, gcdCache *gcdcache.Service) *Native {
+	return &Native{
+		base:   base{hashtabService: hashtabService, gcdCache: gcdCache},
+		loaded: make(map[string]loadedHashtab),
+	}
+}
+
+func (n *Native) Name() string {
+	return "native"
+}
+
+func (n *Native) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	ht, err := n.load(hashtabPath)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("hash-diffs interrupted: %w", err)
+	}
+
+	content, err := os.ReadFile(qmdPath)
+	if err != nil {
+		return fmt.Errorf("failed to read QMD file: %w", err)
+	}
+
+	out, unresolved := qmd.Hash(content, func(s string) (uint64, bool) {
+		hash := hashtab.DJB2Hash(s)
+		str, ok := ht.Lookup(hash)
+		return hash, ok && hash != hashtab.VersionHash && (str == "" || str == s)
+	})
+
+	if err := os.WriteFile(qmdPath, out, 0644); err != nil {
+		return fmt.Errorf("failed to write QMD file: %w", err)
+	}
+
+	if len(unresolved) > 0 {
+		return &UnresolvedWarning{Identifiers: unresolved}
+	}
+	return nil
+}
+
+// load returns the hashtab at path, reusing the parsed copy until the file
+// changes. GCD hashtabs are shared by every file of a job, and across jobs;
+// at most maxLoaded are kept.
+func (n *Native) load(path string) (*hashtab.Hashtab, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat hashtab: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.useTick++
+	if cached, ok := n.loaded[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		cached.lastUsed = n.useTick
+		n.loaded[path] = cached
+		return cached.ht, nil
+	}
+
+	ht, err := hashtab.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hashtab: %w", err)
+	}
+	n.loaded[path] = loadedHashtab{modTime: info.ModTime(), ht: ht, lastUsed: n.useTick}
+
+	for len(n.loaded) > maxLoaded {
+		oldest := ""
+		for p, cached := range n.loaded {
+			if oldest == "" || cached.lastUsed < n.loaded[oldest].lastUsed {
+				oldest = p
+			}
+		}
+		delete(n.loaded, oldest)
+	}
+
+	return ht, nil
+}
+
+// HashFiles hashes each file in turn; the parsed hashtab is shared by all of
+// them.
+func (n *Native) HashFiles(ctx context.Context, hashtabPath string, qmdPaths []string, progress func(done int)) []error {
+	errs := make([]error, len(qmdPaths))
+	for i, path := range qmdPaths {
+		errs[i] = n.HashDiffs(ctx, hashtabPath, path)
+		progress(i + 1)
+	}
+	return errs
+}
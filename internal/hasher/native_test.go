@@ -0,0 +1,64 @@
+package hasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func TestNativeHashDiffs(t *testing.T) {
+	dir := t.TempDir()
+	h := hashtab.DJB2Hash
+
+	hashtabPath := filepath.Join(dir, "gcd")
+	if err := hashtab.Save(hashtabPath, map[uint64]string{h("root"): "root", h("width"): "width"}); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := write("good.qmd", "AFFECT root { width: 1 }")
+	partial := write("partial.qmd", "AFFECT root { id: battery; width: charging }")
+
+	n := NewNative(nil, nil)
+	errs := n.HashFiles(context.Background(), hashtabPath, []string{good, partial}, func(int) {})
+
+	if errs[0] != nil {
+		t.Errorf("good.qmd: %v", errs[0])
+	}
+
+	var warning *UnresolvedWarning
+	if !errors.As(errs[1], &warning) {
+		t.Fatalf("partial.qmd error = %v, want *UnresolvedWarning", errs[1])
+	}
+	if want := []string{"id", "battery", "charging"}; !reflect.DeepEqual(warning.Identifiers, want) {
+		t.Errorf("unresolved = %v, want %v", warning.Identifiers, want)
+	}
+
+	want := fmt.Sprintf("AFFECT [[%d]] { id: battery; [[%d]]: charging }", h("root"), h("width"))
+	if content, _ := os.ReadFile(partial); string(content) != want {
+		t.Errorf("partial.qmd = %q, want %q", content, want)
+	}
+}
+
+func TestUnresolvedWarningTruncates(t *testing.T) {
+	ids := make([]string, maxListedIdentifiers+2)
+	for i := range ids {
+		ids[i] = string(rune('a' + i))
+	}
+	want := "12 identifier(s) not in hashtab left unhashed: a, b, c, d, e, f, g, h, i, j and 2 more"
+	if got := (&UnresolvedWarning{Identifiers: ids}).Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
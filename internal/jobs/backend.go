@@ -0,0 +1,119 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backend persists jobs so they survive restarts.
+type Backend interface {
+	// Write saves and deletes jobs in a single transaction.
+	Write(saves map[string]*Job, deletes []string) error
+	LoadAll() (map[string]*Job, error)
+	Close() error
+}
+
+// record is the persisted form of a Job, including the fields that are
+// hidden from API responses.
+type record struct {
+	Job         *Job       `json:"job"`
+	OutputDir   string     `json:"outputDir,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// MemoryBackend keeps nothing; jobs live only in the Store's map.
+type MemoryBackend struct{}
+
+func (MemoryBackend) Write(saves map[string]*Job, deletes []string) error { return nil }
+func (MemoryBackend) LoadAll() (map[string]*Job, error)                   { return map[string]*Job{}, nil }
+func (MemoryBackend) Close() error                                        { return nil }
+
+var jobsBucket = []byte("jobs")
+
+// BoltBackend stores jobs in a single-file bbolt database.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create job database directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize job database: %w", err)
+	}
+
+	return &BoltBackend{db: db}, nil
+}
+
+func (b *BoltBackend) Write(saves map[string]*Job, deletes []string) error {
+	encoded := make(map[string][]byte, len(saves))
+	for id, job := range saves {
+		data, err := json.Marshal(record{
+			Job:         job,
+			OutputDir:   job.OutputDir,
+			CompletedAt: job.CompletedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode job %s: %w", id, err)
+		}
+		encoded[id] = data
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		for id, data := range encoded {
+			if err := bucket.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		for _, id := range deletes {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) LoadAll() (map[string]*Job, error) {
+	result := make(map[string]*Job)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var rec record
+			if err := json.Unmarshal(v, &rec); err != nil || rec.Job == nil {
+				return nil
+			}
+			rec.Job.OutputDir = rec.OutputDir
+			rec.Job.CompletedAt = rec.CompletedAt
+			result[string(k)] = rec.Job
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jobs: %w", err)
+	}
+
+	return result, nil
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
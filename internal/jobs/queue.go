@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+var ErrQueueFull = errors.New("job queue is full")
+
+type task struct {
+	id  string
+	ctx context.Context
+	run func(ctx context.Context)
+	// stop cancels the republishing of positions when ctx is cancelled.
+	stop func() bool
+}
+
+// Queue runs jobs on a fixed number of workers. Jobs waiting for a worker are
+// reported as "queued" along with their position in the queue.
+type Queue struct {
+	store     *Store
+	maxQueued int
+	mu        sync.Mutex
+	cond      *sync.Cond
+	pending   []*task
+}
+
+func NewQueue(store *Store, workers, maxQueued int) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+
+	q := &Queue{
+		store:     store,
+		maxQueued: maxQueued,
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+
+	return q
+}
+
+// Enqueue schedules run for job id. ctx is passed to run and lets a cancelled
+// job leave the queue without waiting its turn. It returns ErrQueueFull when
+// maxQueued jobs are already waiting.
+func (q *Queue) Enqueue(ctx context.Context, id string, run func(ctx context.Context)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxQueued > 0 && q.waitingLocked() >= q.maxQueued {
+		return ErrQueueFull
+	}
+
+	t := &task{id: id, ctx: ctx, run: run}
+	// A job cancelled while waiting still holds its place until a worker
+	// picks it up and lets it clean up, but the jobs behind it move up now.
+	t.stop = context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.publishPositionsLocked()
+	})
+	q.pending = append(q.pending, t)
+	q.publishPositionsLocked()
+	q.cond.Signal()
+
+	return nil
+}
+
+// Len returns the number of jobs waiting for a worker.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waitingLocked()
+}
+
+func (q *Queue) waitingLocked() int {
+	n := 0
+	for _, t := range q.pending {
+		if t.ctx.Err() == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (q *Queue) publishPositionsLocked() {
+	position := 0
+	for _, t := range q.pending {
+		if t.ctx.Err() != nil {
+			continue
+		}
+		position++
+		q.store.SetQueued(t.id, position)
+	}
+}
+
+func (q *Queue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		t := q.pending[0]
+		q.pending = q.pending[1:]
+		t.stop()
+		q.publishPositionsLocked()
+		q.mu.Unlock()
+
+		q.runTask(t)
+	}
+}
+
+func (q *Queue) runTask(t *task) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Error(logging.ComponentJob, "Job %s panicked: %v", t.id, r)
+			q.store.Update(t.id, "error", fmt.Sprintf("Internal error: %v", r), nil)
+		}
+	}()
+
+	t.run(t.ctx)
+}
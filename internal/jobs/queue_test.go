@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueueRepublishesPositionsOnCancel(t *testing.T) {
+	store, err := NewStore(MemoryBackend{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueue(store, 1, 0)
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	enqueue := func(id string, run func(ctx context.Context)) {
+		store.Create(id, "hash", 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		store.SetCancel(id, cancel)
+		if err := q.Enqueue(ctx, id, run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueue("running", func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+	for _, id := range []string{"first", "second", "third"} {
+		enqueue(id, func(ctx context.Context) {})
+	}
+
+	store.Cancel("first")
+
+	positions := func() (int, int) {
+		second, _ := store.Snapshot("second")
+		third, _ := store.Snapshot("third")
+		return second.QueuePosition, third.QueuePosition
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if second, third := positions(); second == 1 && third == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second, third := positions()
+	t.Errorf("queue positions after cancel = %d, %d, want 1, 2", second, third)
+}
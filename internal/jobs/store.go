@@ -1,57 +1,300 @@
 package jobs
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
 )
 
+// DeviceResult is the outcome of verifying a hashed file against one device.
+type DeviceResult struct {
+	Passed bool `json:"passed"`
+	// Missing lists the hashes, in decimal, that the device lacks; with
+	// qmldiff verify, the tokens it reported instead.
+	Missing []string `json:"missing,omitempty"`
+	// Error is qmldiff verify's failure, when it ran.
+	Error string `json:"error,omitempty"`
+}
+
+// DroppedIdentifier is an identifier of a file that the GCD lacks because
+// some target devices do not have it.
+type DroppedIdentifier struct {
+	Identifier string   `json:"identifier"`
+	Hash       uint64   `json:"hash,string"`
+	PresentOn  []string `json:"presentOn"`
+	MissingOn  []string `json:"missingOn"`
+}
+
+// Diagnostic is one problem reported while hashing a file. Line and Column
+// are 1-based; zero means unknown.
+type Diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Token    string `json:"token,omitempty"`
+}
+
 type FileResult struct {
 	Name   string `json:"name"`
 	Path   string `json:"path"`
 	Status string `json:"status"`
 	Error  string `json:"error,omitempty"`
+	// Unresolved lists hashes, in decimal, that an unhash job could not resolve.
+	Unresolved []string `json:"unresolved,omitempty"`
+	// Missing lists identifiers a migrate job found absent from the target.
+	Missing []string `json:"missing,omitempty"`
+	// Devices holds per-device verification results when verification was requested.
+	Devices map[string]DeviceResult `json:"devices,omitempty"`
+	// Unhashed lists identifiers verification found still in plain form
+	// although a target device has them.
+	Unhashed []string `json:"unhashed,omitempty"`
+	// Unverified is set on a hashed file that failed verification. Its
+	// output is kept and downloadable so it can be inspected.
+	Unverified bool `json:"unverified,omitempty"`
+	// Dropped lists identifiers in the file that the GCD lacks because some
+	// target devices do not have them.
+	Dropped []DroppedIdentifier `json:"dropped,omitempty"`
+	// Diagnostics holds the problems qmldiff reported for a failed file, or
+	// warnings for tokens a hashed file kept in plain form.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	// Abnormal is set when qmldiff crashed or hit a resource limit on the file.
+	Abnormal bool `json:"abnormal,omitempty"`
 }
 
 type Job struct {
-	Status      string                 `json:"status"`
-	Message     string                 `json:"message"`
-	Data        map[string]string      `json:"data,omitempty"`
-	Progress    int                    `json:"progress"`
-	Operation   string                 `json:"operation,omitempty"`
-	Files       []FileResult           `json:"files,omitempty"`
-	OutputDir   string                 `json:"-"`
-	FileCount   int                    `json:"fileCount,omitempty"`
-	CompletedAt *time.Time             `json:"-"`
+	Type          string            `json:"type,omitempty"`
+	Status        string            `json:"status"`
+	Message       string            `json:"message"`
+	Data          map[string]string `json:"data,omitempty"`
+	Progress      int               `json:"progress"`
+	Operation     string            `json:"operation,omitempty"`
+	Files         []FileResult      `json:"files,omitempty"`
+	Versions      []string          `json:"versions,omitempty"`
+	Devices       []string          `json:"devices,omitempty"`
+	Excluded      map[string]int    `json:"excludedCounts,omitempty"`
+	QueuePosition int               `json:"queuePosition,omitempty"`
+	OutputDir     string            `json:"-"`
+	FileCount     int               `json:"fileCount,omitempty"`
+	CompletedAt   *time.Time        `json:"-"`
+	ExpiresAt     *time.Time        `json:"expiresAt,omitempty"`
+}
+
+// IsTerminal reports whether status is a final job status.
+func IsTerminal(status string) bool {
+	return status == "success" || status == "error" || status == "cancelled"
 }
 
 type Store struct {
 	mu       sync.RWMutex
 	jobs     map[string]*Job
 	watchers map[string][]chan *Job
+	cancels  map[string]context.CancelFunc
+	backend  Backend
+	ttl      time.Duration
+
+	// dirty holds the jobs changed or deleted since the writer last ran.
+	// The writer persists them outside mu, so disk I/O never blocks the
+	// store; wake signals it and is closed by Close.
+	dirty      map[string]bool
+	wake       chan struct{}
+	closed     bool
+	writerDone chan struct{}
 }
 
-func NewStore() *Store {
+// NewStore creates a job store persisted through backend and reloads the jobs
+// it already holds. Jobs that were still in progress when the server stopped
+// are marked as failed. A nil backend keeps jobs in memory only. Finished jobs
+// expire ttl after completion; see RemoveExpired.
+func NewStore(backend Backend, ttl time.Duration) (*Store, error) {
+	if backend == nil {
+		backend = MemoryBackend{}
+	}
+
 	s := &Store{
-		jobs:     make(map[string]*Job),
-		watchers: make(map[string][]chan *Job),
+		jobs:       make(map[string]*Job),
+		watchers:   make(map[string][]chan *Job),
+		cancels:    make(map[string]context.CancelFunc),
+		backend:    backend,
+		ttl:        ttl,
+		dirty:      make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+		writerDone: make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	go s.writer()
+	s.wake <- struct{}{}
+
+	return s, nil
+}
+
+func (s *Store) completeLocked(j *Job) {
+	if j.CompletedAt != nil {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	j.CompletedAt = &now
+	j.ExpiresAt = &expires
+}
+
+func (s *Store) load() error {
+	loaded, err := s.backend.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	interrupted, lost := 0, 0
+	for id, j := range loaded {
+		if !IsTerminal(j.Status) {
+			j.Status = "error"
+			j.Message = "Job interrupted by server restart"
+			j.QueuePosition = 0
+			s.completeLocked(j)
+			s.dirty[id] = true
+			interrupted++
+		} else if j.Status == "success" && !outputExists(j.OutputDir) {
+			// The work directory is not persistent, e.g. a redeployed
+			// container without WORK_DIR on a volume.
+			j.Status = "error"
+			j.Message = "Job output was lost when the server restarted"
+			s.completeLocked(j)
+			s.dirty[id] = true
+			lost++
+		} else if j.ExpiresAt == nil && j.CompletedAt != nil {
+			expires := j.CompletedAt.Add(s.ttl)
+			j.ExpiresAt = &expires
+		}
+		s.jobs[id] = j
+		s.watchers[id] = []chan *Job{}
+	}
+
+	if len(loaded) > 0 {
+		logging.Info(logging.ComponentJob, "Restored %d job(s), %d marked as interrupted, %d with missing output", len(loaded), interrupted, lost)
+	}
+
+	return nil
+}
+
+// outputExists reports whether a job's output directory is still on disk.
+func outputExists(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// Close writes out pending changes and releases the persistence backend.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.wake)
+	}
+	s.mu.Unlock()
+
+	<-s.writerDone
+	return s.backend.Close()
+}
+
+// persistLocked marks job id, or its deletion if it is gone, to be written
+// by the writer.
+func (s *Store) persistLocked(id string) {
+	if s.closed {
+		return
+	}
+	s.dirty[id] = true
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Store) deleteLocked(id string) {
+	delete(s.watchers, id)
+	delete(s.jobs, id)
+	delete(s.cancels, id)
+	s.persistLocked(id)
+}
+
+// writer persists dirty jobs until Close. Changes made while it writes are
+// picked up on the next round, so a busy job is written once per round
+// rather than once per update.
+func (s *Store) writer() {
+	defer close(s.writerDone)
+	for range s.wake {
+		s.flush()
+	}
+	s.flush()
+}
+
+func (s *Store) flush() {
+	s.mu.Lock()
+	if len(s.dirty) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	saves := make(map[string]*Job, len(s.dirty))
+	var deletes []string
+	for id := range s.dirty {
+		if j, ok := s.jobs[id]; ok {
+			saves[id] = s.snapshotLocked(j)
+		} else {
+			deletes = append(deletes, id)
+		}
+	}
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+
+	if err := s.backend.Write(saves, deletes); err != nil {
+		logging.Warn(logging.ComponentJob, "Failed to persist %d job(s): %v", len(saves)+len(deletes), err)
+		// Retry with the next change rather than losing these.
+		s.mu.Lock()
+		for id := range saves {
+			s.dirty[id] = true
+		}
+		for _, id := range deletes {
+			s.dirty[id] = true
+		}
+		s.mu.Unlock()
 	}
-	go s.startCleanup()
-	return s
 }
 
-func (s *Store) Create(id string) *Job {
+// snapshotLocked copies j, including the fields hidden from API responses,
+// so it can be encoded without holding mu.
+func (s *Store) snapshotLocked(j *Job) *Job {
+	snapshot := s.copyJob(j)
+	snapshot.OutputDir = j.OutputDir
+	snapshot.CompletedAt = j.CompletedAt
+	return snapshot
+}
+
+// Create adds a pending job of jobType over fileCount files. The job is
+// persisted from then on, so it is only changed through the store.
+func (s *Store) Create(id, jobType string, fileCount int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	j := &Job{
-		Status:   "pending",
-		Message:  "Job created",
-		Progress: 0,
-		Files:    []FileResult{},
+	s.jobs[id] = &Job{
+		Type:      jobType,
+		Status:    "pending",
+		Message:   "Job created",
+		Progress:  0,
+		Files:     []FileResult{},
+		FileCount: fileCount,
 	}
-	s.jobs[id] = j
 	s.watchers[id] = []chan *Job{}
-	return j
+	s.persistLocked(id)
 }
 
 func (s *Store) Get(id string) (*Job, bool) {
@@ -61,19 +304,33 @@ func (s *Store) Get(id string) (*Job, bool) {
 	return j, ok
 }
 
+// Snapshot returns a copy of job id taken under the lock, including the
+// fields hidden from API responses. Unlike the job Get returns, it can be
+// read while the job is still being updated.
+func (s *Store) Snapshot(id string) (*Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return s.snapshotLocked(j), true
+}
+
 func (s *Store) Update(id, status, message string, data map[string]string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if j, ok := s.jobs[id]; ok {
+	if j, ok := s.jobs[id]; ok && j.Status != "cancelled" {
 		j.Status = status
 		j.Message = message
+		j.QueuePosition = 0
 		if data != nil {
 			j.Data = data
 		}
-		if (status == "success" || status == "error") && j.CompletedAt == nil {
-			now := time.Now()
-			j.CompletedAt = &now
+		if IsTerminal(status) {
+			s.completeLocked(j)
 		}
+		s.persistLocked(id)
 		s.broadcastLocked(id)
 	}
 }
@@ -95,26 +352,90 @@ func (s *Store) UpdateProgress(id string, p int) {
 func (s *Store) UpdateWithOperation(id, status, message string, data map[string]string, operation string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if j, ok := s.jobs[id]; ok {
+	if j, ok := s.jobs[id]; ok && j.Status != "cancelled" {
 		j.Status = status
 		j.Message = message
+		j.QueuePosition = 0
 		if data != nil {
 			j.Data = data
 		}
 		j.Operation = operation
-		if (status == "success" || status == "error") && j.CompletedAt == nil {
-			now := time.Now()
-			j.CompletedAt = &now
+		if IsTerminal(status) {
+			s.completeLocked(j)
+		}
+		s.persistLocked(id)
+		s.broadcastLocked(id)
+	}
+}
+
+// SetQueued marks a job as waiting for a worker at the given 1-based position.
+func (s *Store) SetQueued(id string, position int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok && (j.Status == "pending" || j.Status == "queued") {
+		if j.Status == "queued" && j.QueuePosition == position {
+			return
 		}
+		j.Status = "queued"
+		j.Message = fmt.Sprintf("Waiting in queue (position %d)", position)
+		j.QueuePosition = position
 		s.broadcastLocked(id)
 	}
 }
 
+// SetCancel registers the function that stops a job's work when it is cancelled.
+func (s *Store) SetCancel(id string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; ok {
+		s.cancels[id] = cancel
+	}
+}
+
+// Cancel stops a running job and publishes a terminal "cancelled" status.
+// It returns false if the job does not exist or has already finished.
+func (s *Store) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || IsTerminal(j.Status) {
+		return false
+	}
+
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+	}
+
+	j.Status = "cancelled"
+	j.Message = "Job cancelled"
+	s.completeLocked(j)
+	s.persistLocked(id)
+	s.broadcastLocked(id)
+
+	return true
+}
+
 func (s *Store) SetOutputDir(id string, outputDir string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if j, ok := s.jobs[id]; ok {
 		j.OutputDir = outputDir
+		s.persistLocked(id)
+	}
+}
+
+// SetTarget records the versions and devices a job's GCD covers, and for
+// cross-version GCDs how many entries each version lost.
+func (s *Store) SetTarget(id string, versions, devices []string, excluded map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		j.Versions = versions
+		j.Devices = devices
+		j.Excluded = excluded
+		s.persistLocked(id)
+		s.broadcastLocked(id)
 	}
 }
 
@@ -124,6 +445,7 @@ func (s *Store) SetFiles(id string, files []FileResult) {
 	if j, ok := s.jobs[id]; ok {
 		j.Files = files
 		j.FileCount = len(files)
+		s.persistLocked(id)
 	}
 }
 
@@ -133,6 +455,7 @@ func (s *Store) AddFile(id string, file FileResult) {
 	if j, ok := s.jobs[id]; ok {
 		j.Files = append(j.Files, file)
 		j.FileCount = len(j.Files)
+		s.persistLocked(id)
 		s.broadcastLocked(id)
 	}
 }
@@ -142,13 +465,10 @@ func (s *Store) Subscribe(id string) (<-chan *Job, func()) {
 
 	s.mu.Lock()
 	s.watchers[id] = append(s.watchers[id], ch)
-	job := s.jobs[id]
-	s.mu.Unlock()
-
-	if job != nil {
-		jobCopy := s.copyJob(job)
-		ch <- jobCopy
+	if job := s.jobs[id]; job != nil {
+		ch <- s.copyJob(job)
 	}
+	s.mu.Unlock()
 
 	unsubscribe := func() {
 		s.mu.Lock()
@@ -168,12 +488,15 @@ func (s *Store) Subscribe(id string) (<-chan *Job, func()) {
 
 func (s *Store) copyJob(job *Job) *Job {
 	jobCopy := &Job{
-		Status:    job.Status,
-		Message:   job.Message,
-		Data:      make(map[string]string),
-		Progress:  job.Progress,
-		Operation: job.Operation,
-		FileCount: job.FileCount,
+		Type:          job.Type,
+		Status:        job.Status,
+		Message:       job.Message,
+		Data:          make(map[string]string),
+		Progress:      job.Progress,
+		Operation:     job.Operation,
+		FileCount:     job.FileCount,
+		QueuePosition: job.QueuePosition,
+		ExpiresAt:     job.ExpiresAt,
 	}
 	for k, v := range job.Data {
 		jobCopy.Data[k] = v
@@ -182,6 +505,20 @@ func (s *Store) copyJob(job *Job) *Job {
 		jobCopy.Files = make([]FileResult, len(job.Files))
 		copy(jobCopy.Files, job.Files)
 	}
+	if len(job.Versions) > 0 {
+		jobCopy.Versions = make([]string, len(job.Versions))
+		copy(jobCopy.Versions, job.Versions)
+	}
+	if len(job.Devices) > 0 {
+		jobCopy.Devices = make([]string, len(job.Devices))
+		copy(jobCopy.Devices, job.Devices)
+	}
+	if len(job.Excluded) > 0 {
+		jobCopy.Excluded = make(map[string]int, len(job.Excluded))
+		for k, v := range job.Excluded {
+			jobCopy.Excluded[k] = v
+		}
+	}
 	return jobCopy
 }
 
@@ -209,32 +546,39 @@ func (s *Store) Cleanup(id string) {
 		close(ch)
 	}
 
-	delete(s.watchers, id)
-	delete(s.jobs, id)
+	s.deleteLocked(id)
 }
 
-func (s *Store) startCleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+// RemoveExpired drops finished jobs whose expiry time has passed and that
+// nobody is watching, and returns them so their files can be deleted.
+func (s *Store) RemoveExpired(now time.Time) []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for range ticker.C {
-		s.cleanupOldJobs()
+	var expired []*Job
+	for id, job := range s.jobs {
+		if job.ExpiresAt == nil || now.Before(*job.ExpiresAt) {
+			continue
+		}
+		if len(s.watchers[id]) == 0 {
+			expired = append(expired, job)
+			s.deleteLocked(id)
+		}
 	}
-}
 
-func (s *Store) cleanupOldJobs() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return expired
+}
 
-	now := time.Now()
-	ttl := 10 * time.Minute
+// OutputDirs returns the output directories of every job in the store.
+func (s *Store) OutputDirs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for id, job := range s.jobs {
-		if job.CompletedAt != nil && now.Sub(*job.CompletedAt) > ttl {
-			if len(s.watchers[id]) == 0 {
-				delete(s.jobs, id)
-				delete(s.watchers, id)
-			}
+	dirs := make([]string, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if job.OutputDir != "" {
+			dirs = append(dirs, job.OutputDir)
 		}
 	}
+	return dirs
 }
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsThroughBackend(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "jobs.db")
+	outputDir := t.TempDir()
+
+	open := func() *Store {
+		t.Helper()
+		backend, err := NewBoltBackend(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := NewStore(backend, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	store := open()
+	store.Create("done", "hash", 1)
+	store.SetOutputDir("done", outputDir)
+	store.SetFiles("done", []FileResult{{Name: "a.qmd", Path: "a.qmd", Status: "success"}})
+	store.Update("done", "success", "Hashed 1 file(s)", nil)
+	store.Create("running", "migrate", 3)
+	store.UpdateWithOperation("running", "running", "Hashing files", nil, "hashing")
+	store.Create("removed", "hash", 1)
+	store.Cleanup("removed")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = open()
+	defer store.Close()
+
+	done, ok := store.Get("done")
+	if !ok || done.Status != "success" || done.OutputDir != outputDir || len(done.Files) != 1 || done.CompletedAt == nil {
+		t.Errorf("done = %+v, want the finished job with its output", done)
+	}
+	if running, ok := store.Get("running"); !ok || running.Status != "error" || running.Type != "migrate" || running.FileCount != 3 {
+		t.Errorf("running = %+v, want the migrate job over 3 files marked as interrupted", running)
+	}
+	if _, ok := store.Get("removed"); ok {
+		t.Error("removed job was restored")
+	}
+}
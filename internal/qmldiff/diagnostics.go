@@ -0,0 +1,165 @@
+package qmldiff
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is one problem reported by qmldiff, located as precisely as its
+// output allows. Line and Column are 1-based; zero means unknown.
+type Diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// Token is the identifier or [[hash]] the message quotes first, if any.
+	Token string `json:"token,omitempty"`
+}
+
+// Error is returned when qmldiff exits unsuccessfully. It keeps the raw output
+// alongside the diagnostics parsed from it. Abnormal is set when the process
+// crashed or hit a resource limit rather than rejecting its input.
+//
+// The raw output names server paths, so Error() leaves it out; only the
+// diagnostics, once their paths are made relative, are meant for clients.
+type Error struct {
+	Command     string
+	Err         error
+	Stdout      string
+	Stderr      string
+	Diagnostics []Diagnostic
+	Abnormal    string
+}
+
+func (e *Error) Error() string {
+	if e.Abnormal != "" {
+		return fmt.Sprintf("%s terminated abnormally: %s", e.Command, e.Abnormal)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Command, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// locatedPattern matches "file:line[:column]: [severity:] message".
+	locatedPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?:\s*(?:(?i:(error|warning|note|info))\s*:\s*)?(.*)$`)
+	// severityPattern matches "severity: message" and "severity[code]: message".
+	severityPattern = regexp.MustCompile(`^(?i:(error|warning|note|info))(?:\[[^\]]*\])?\s*:\s*(.*)$`)
+	// arrowPattern matches a rustc-style "--> file:line:column" location line.
+	arrowPattern = regexp.MustCompile(`^-->\s*(.+?):(\d+)(?::(\d+))?$`)
+	// lineSuffixPattern matches a trailing "at line N[, column M]".
+	lineSuffixPattern = regexp.MustCompile(`(?i)\s*\(?\bat line (\d+)(?:,? col(?:umn)? (\d+))?\)?\s*$`)
+	// panicPattern matches the first line of a Rust panic, with the message
+	// inline (before Rust 1.73) or on the following line.
+	panicPattern = regexp.MustCompile(`^thread '[^']*' panicked at (?:'(.*)', )?\S+?:\d+(?::\d+)?:?$`)
+	// backtraceNotePattern matches the hint Rust prints after a panic.
+	backtraceNotePattern = regexp.MustCompile("^note: run with `RUST_BACKTRACE")
+	// tokenPattern matches the first quoted text in a message.
+	tokenPattern = regexp.MustCompile("'([^']+)'|\"([^\"]+)\"|`([^`]+)`")
+	// identifierPattern matches the quoted text kept as a diagnostic's token:
+	// an identifier or a [[hash]], not code such as "Option::unwrap()".
+	identifierPattern = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_]*|\[\[\d+\]\])$`)
+)
+
+// ParseDiagnostics extracts diagnostics from qmldiff output. Lines it does not
+// recognise are ignored, except that a failure with no recognised lines yields
+// a single diagnostic holding the first non-empty line.
+func ParseDiagnostics(output string) []Diagnostic {
+	var diags []Diagnostic
+	var fallback string
+	panicking := false
+
+	for _, raw := range strings.Split(output, "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+		if fallback == "" {
+			fallback = line
+		}
+
+		// A panic is located in qmldiff's own source, not the input, so it is
+		// reported without a file.
+		if m := panicPattern.FindStringSubmatch(line); m != nil {
+			if m[1] != "" {
+				diags = append(diags, newDiagnostic("", "", "", "error", "qmldiff panicked: "+m[1]))
+			} else {
+				panicking = true
+			}
+			continue
+		}
+		if panicking {
+			diags = append(diags, newDiagnostic("", "", "", "error", "qmldiff panicked: "+line))
+			panicking = false
+			continue
+		}
+		if backtraceNotePattern.MatchString(line) {
+			continue
+		}
+
+		if m := arrowPattern.FindStringSubmatch(line); m != nil {
+			if len(diags) > 0 && diags[len(diags)-1].Line == 0 {
+				d := &diags[len(diags)-1]
+				d.File = m[1]
+				d.Line = atoi(m[2])
+				d.Column = atoi(m[3])
+			}
+			continue
+		}
+
+		if m := severityPattern.FindStringSubmatch(line); m != nil {
+			diags = append(diags, newDiagnostic("", "", "", m[1], m[2]))
+			continue
+		}
+
+		if m := locatedPattern.FindStringSubmatch(line); m != nil {
+			diags = append(diags, newDiagnostic(m[1], m[2], m[3], m[4], m[5]))
+			continue
+		}
+	}
+
+	if len(diags) == 0 && fallback != "" {
+		diags = append(diags, newDiagnostic("", "", "", "error", fallback))
+	}
+
+	return diags
+}
+
+func newDiagnostic(file, line, column, severity, message string) Diagnostic {
+	d := Diagnostic{
+		File:     file,
+		Line:     atoi(line),
+		Column:   atoi(column),
+		Severity: strings.ToLower(severity),
+		Message:  strings.TrimSpace(message),
+	}
+	if d.Severity == "" {
+		d.Severity = "error"
+	}
+
+	if d.Line == 0 {
+		if m := lineSuffixPattern.FindStringSubmatch(d.Message); m != nil {
+			d.Line = atoi(m[1])
+			d.Column = atoi(m[2])
+			d.Message = strings.TrimSpace(d.Message[:len(d.Message)-len(m[0])])
+		}
+	}
+
+	if m := tokenPattern.FindStringSubmatch(d.Message); m != nil {
+		if token := m[1] + m[2] + m[3]; identifierPattern.MatchString(token) {
+			d.Token = token
+		}
+	}
+
+	return d
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,133 @@
+package qmldiff
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The panic and allocation-failure fixtures in testdata are in the formats the
+// Rust runtime prints. The others are written in the common file-located,
+// rustc-style and "at line" shapes the parser accepts; they are not captured
+// qmldiff output.
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []Diagnostic
+	}{
+		{
+			fixture: "panic.txt",
+			want: []Diagnostic{
+				{Severity: "error", Message: "qmldiff panicked: called `Option::unwrap()` on a `None` value"},
+			},
+		},
+		{
+			fixture: "panic_inline.txt",
+			want: []Diagnostic{
+				{Severity: "error", Message: "qmldiff panicked: Cannot resolve hash of 'batteryIndicator'", Token: "batteryIndicator"},
+			},
+		},
+		{
+			fixture: "alloc.txt",
+			want: []Diagnostic{
+				{Severity: "error", Message: "memory allocation of 4294967296 bytes failed"},
+			},
+		},
+		{
+			fixture: "located.txt",
+			want: []Diagnostic{
+				{File: "/tmp/rm-qmd-hasher/hash-output-123/folder/file1.qmd", Line: 12, Column: 5, Severity: "error", Message: "unknown identifier 'batteryIndicator'", Token: "batteryIndicator"},
+				{File: "/tmp/rm-qmd-hasher/hash-output-123/folder/file1.qmd", Line: 20, Severity: "warning", Message: `unused slot "footer"`, Token: "footer"},
+			},
+		},
+		{
+			fixture: "arrow.txt",
+			want: []Diagnostic{
+				{File: "/tmp/rm-qmd-hasher/hash-output-123/file1.qmd", Line: 12, Column: 5, Severity: "error", Message: "cannot hash `batteryIndicator`: not in hashtab", Token: "batteryIndicator"},
+			},
+		},
+		{
+			fixture: "line_suffix.txt",
+			want: []Diagnostic{
+				{Line: 12, Column: 5, Severity: "error", Message: "Unexpected token 'END'", Token: "END"},
+			},
+		},
+		{
+			fixture: "unrecognised.txt",
+			want: []Diagnostic{
+				{Severity: "error", Message: "Processing /tmp/rm-qmd-hasher/hash-output-123/file1.qmd"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ParseDiagnostics(string(data))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDiagnostics:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticToken(t *testing.T) {
+	tests := []struct {
+		line  string
+		token string
+	}{
+		{"error: unknown identifier 'batteryIndicator'", "batteryIndicator"},
+		{"error: hash '[[2335641427]]' not found", "[[2335641427]]"},
+		{"error: called `Option::unwrap()` on a `None` value", ""},
+		{"error: expected ';' after \"width\"", ""},
+		{"error: cannot open 'file1.qmd'", ""},
+		{"error: unexpected end of input", ""},
+	}
+
+	for _, tt := range tests {
+		diags := ParseDiagnostics(tt.line)
+		if len(diags) != 1 || diags[0].Token != tt.token {
+			t.Errorf("ParseDiagnostics(%q) = %+v, want token %q", tt.line, diags, tt.token)
+		}
+	}
+}
+
+func TestParseDiagnosticsEmpty(t *testing.T) {
+	if got := ParseDiagnostics("\n  \n"); len(got) != 0 {
+		t.Errorf("ParseDiagnostics of blank output = %+v, want none", got)
+	}
+}
+
+func TestErrorOmitsRawOutput(t *testing.T) {
+	stderr, err := os.ReadFile(filepath.Join("testdata", "located.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qerr := &Error{
+		Command: "hash-diffs",
+		Err:     &exec.ExitError{},
+		Stderr:  string(stderr),
+		Stdout:  "/tmp/rm-qmd-hasher/hash-output-123/folder/file1.qmd",
+	}
+	if msg := qerr.Error(); strings.Contains(msg, "/tmp/") {
+		t.Errorf("Error() exposes server paths: %q", msg)
+	}
+
+	qerr.Abnormal = "CPU time limit exceeded"
+	if msg := qerr.Error(); msg != "hash-diffs terminated abnormally: CPU time limit exceeded" {
+		t.Errorf("Error() = %q", msg)
+	}
+
+	var target *exec.ExitError
+	if !errors.As(qerr, &target) {
+		t.Error("Error does not unwrap to its cause")
+	}
+}
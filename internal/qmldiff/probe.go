@@ -0,0 +1,218 @@
+package qmldiff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+// probeTimeout bounds each invocation of the binary during Probe.
+const probeTimeout = 10 * time.Second
+
+// requiredSubcommands are the qmldiff subcommands this service runs.
+var requiredSubcommands = []string{"hash-diffs"}
+
+// commandsHeaderPattern matches the line that starts the subcommand list in
+// help output: "Commands:" with clap 3 and later, "SUBCOMMANDS:" before.
+var commandsHeaderPattern = regexp.MustCompile(`^(?i:commands|subcommands):\s*$`)
+
+// subcommandNamePattern matches a subcommand name.
+var subcommandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(?:-[a-z0-9]+)*$`)
+
+// commitPattern matches a git commit hash, abbreviated or full.
+var commitPattern = regexp.MustCompile(`\b[0-9a-f]{7,40}\b`)
+
+// hexLetterPattern matches the letters only a hash, not a number, contains.
+var hexLetterPattern = regexp.MustCompile(`[a-f]`)
+
+// Capabilities describes the qmldiff binary as found by Probe.
+type Capabilities struct {
+	Binary          string    `json:"binary"`
+	Available       bool      `json:"available"`
+	Version         string    `json:"version,omitempty"`
+	ExpectedVersion string    `json:"expectedVersion,omitempty"`
+	Commit          string    `json:"commit,omitempty"`
+	PinnedCommit    string    `json:"pinnedCommit,omitempty"`
+	Subcommands     []string  `json:"subcommands"`
+	Degraded        bool      `json:"degraded"`
+	Problems        []string  `json:"problems,omitempty"`
+	ProbedAt        time.Time `json:"probedAt"`
+}
+
+// Probe runs the binary to find its version, commit and supported
+// subcommands, and records the result for Capabilities. The binary is reported
+// degraded if it cannot be run, lacks a subcommand the service needs, its
+// version does not contain expectedVersion, or it was built from a commit
+// other than pinnedCommit.
+//
+// The commit is taken from the version output if it has one, and otherwise
+// from a "<binary>.commit" file written next to the binary when it was built.
+// If neither exists the pinned commit cannot be checked, which is logged.
+func (s *Service) Probe(ctx context.Context, expectedVersion, pinnedCommit string) *Capabilities {
+	caps := &Capabilities{
+		Binary:          s.binaryPath,
+		ExpectedVersion: expectedVersion,
+		PinnedCommit:    pinnedCommit,
+		Subcommands:     []string{},
+		ProbedAt:        time.Now(),
+	}
+
+	versionOut, err := s.probeRun(ctx, "--version")
+	if err != nil {
+		caps.Problems = append(caps.Problems, fmt.Sprintf("cannot run %s: %v", s.binaryPath, err))
+	} else {
+		caps.Available = true
+		caps.Version = firstLine(versionOut)
+	}
+
+	if caps.Available {
+		helpOut, err := s.probeRun(ctx, "--help")
+		if err != nil {
+			caps.Problems = append(caps.Problems, fmt.Sprintf("failed to read help: %v", err))
+		}
+		caps.Subcommands = parseSubcommands(helpOut)
+
+		for _, required := range requiredSubcommands {
+			if !slices.Contains(caps.Subcommands, required) {
+				caps.Problems = append(caps.Problems, fmt.Sprintf("missing required subcommand %s", required))
+			}
+		}
+
+		if expectedVersion != "" && !strings.Contains(caps.Version, expectedVersion) {
+			caps.Problems = append(caps.Problems, fmt.Sprintf("version %q does not match expected %q", caps.Version, expectedVersion))
+		}
+
+		caps.Commit = s.binaryCommit(versionOut)
+		switch {
+		case pinnedCommit == "":
+		case caps.Commit == "":
+			logging.Warn(logging.ComponentQMLDiff, "Cannot tell which commit %s was built from, so it is not checked against QMLDIFF_COMMIT %s", s.binaryPath, pinnedCommit)
+		case !sameCommit(caps.Commit, pinnedCommit):
+			caps.Problems = append(caps.Problems, fmt.Sprintf("built from commit %s, not the pinned %s", caps.Commit, pinnedCommit))
+		}
+	}
+
+	caps.Degraded = len(caps.Problems) > 0
+
+	s.mu.Lock()
+	s.capabilities = caps
+	s.mu.Unlock()
+
+	if caps.Degraded {
+		logging.Warn(logging.ComponentQMLDiff, "qmldiff binary %s is degraded: %s", s.binaryPath, strings.Join(caps.Problems, "; "))
+	} else {
+		logging.Info(logging.ComponentQMLDiff, "qmldiff %s supports: %s", caps.Version, strings.Join(caps.Subcommands, ", "))
+	}
+
+	return caps
+}
+
+// Capabilities returns the result of the last Probe, or nil if it never ran.
+func (s *Service) Capabilities() *Capabilities {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.capabilities
+}
+
+// probeRun runs the binary with args and returns its combined output. A
+// non-zero exit status is not an error, as some CLIs exit 1 after printing
+// help; only failing to start the binary is.
+func (s *Service) probeRun(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.binaryPath, args...)
+	cmd.WaitDelay = waitDelay
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return string(out), fmt.Errorf("timed out: %w", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// parseSubcommands returns the subcommands listed in the "Commands:" section
+// of help output: the first field of each line indented like the first entry.
+// Deeper indented lines continue a description and are skipped; the section
+// ends at a blank or unindented line.
+func parseSubcommands(help string) []string {
+	subcommands := []string{}
+	inSection := false
+	indent := ""
+
+	for _, line := range strings.Split(help, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if !inSection {
+			inSection = commandsHeaderPattern.MatchString(strings.TrimSpace(line))
+			continue
+		}
+
+		trimmed := strings.TrimLeft(line, " \t")
+		lineIndent := line[:len(line)-len(trimmed)]
+		if trimmed == "" || lineIndent == "" {
+			break
+		}
+		if indent == "" {
+			indent = lineIndent
+		}
+		if lineIndent != indent {
+			continue
+		}
+
+		name := strings.Fields(trimmed)[0]
+		if subcommandNamePattern.MatchString(name) && name != "help" && !slices.Contains(subcommands, name) {
+			subcommands = append(subcommands, name)
+		}
+	}
+
+	sort.Strings(subcommands)
+	return subcommands
+}
+
+// binaryCommit returns the commit the binary was built from, from its version
+// output or the file next to it, or "" if neither names one.
+func (s *Service) binaryCommit(versionOut string) string {
+	// Dates and build numbers also look like short hashes, so only a token
+	// with a letter is taken from the version.
+	for _, token := range commitPattern.FindAllString(versionOut, -1) {
+		if hexLetterPattern.MatchString(token) {
+			return token
+		}
+	}
+	data, err := os.ReadFile(s.binaryPath + ".commit")
+	if err != nil {
+		return ""
+	}
+	return commitPattern.FindString(strings.ToLower(string(data)))
+}
+
+// sameCommit reports whether two commit hashes, either possibly abbreviated,
+// name the same commit.
+func sameCommit(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return a != "" && strings.HasPrefix(b, a)
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,91 @@
+package qmldiff
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/sandbox"
+)
+
+const clapHelp = `Usage: qmldiff <COMMAND>
+
+Commands:
+  apply-diffs  Apply diffs to a tree of QML files; they are not hashed
+               again, run verify first if unsure
+  hash-diffs   Hash the identifiers of diff files
+  help         Print this message or the help of the given subcommand(s)
+
+Options:
+  -h, --help     Print help (see verify for details)
+  -V, --version  Print version
+`
+
+func TestParseSubcommands(t *testing.T) {
+	tests := []struct {
+		name string
+		help string
+		want []string
+	}{
+		{"clap", clapHelp, []string{"apply-diffs", "hash-diffs"}},
+		{"clap 2", "qmldiff 0.1.0\n\nUSAGE:\n    qmldiff <SUBCOMMAND>\n\nSUBCOMMANDS:\n    gcd-hashtab    Build a GCD\n    verify         Verify hashed diffs\n", []string{"gcd-hashtab", "verify"}},
+		{"no section", "hash-diffs and verify are mentioned but not listed\n", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSubcommands(tt.help); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSubcommands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeChecksPinnedCommit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as the binary")
+	}
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "qmldiff")
+	script := "#!/bin/sh\nif [ \"$1\" = --version ]; then echo 'qmldiff 0.1.0'; else cat <<'EOF'\n" + clapHelp + "EOF\nfi\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		built    string
+		pinned   string
+		commit   string
+		degraded bool
+	}{
+		{"matching", "fce7000a1b2c3d4e5f60718293a4b5c6d7e8f901\n", "fce7000", "fce7000a1b2c3d4e5f60718293a4b5c6d7e8f901", false},
+		{"mismatched", "0123abc4567\n", "fce7000", "0123abc4567", true},
+		{"unknown", "", "fce7000", "", false},
+		{"not pinned", "0123abc4567\n", "", "0123abc4567", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(binary + ".commit")
+			if tt.built != "" {
+				if err := os.WriteFile(binary+".commit", []byte(tt.built), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			caps := NewService(binary, sandbox.Limits{}, t.TempDir()).Probe(context.Background(), "", tt.pinned)
+			if caps.Commit != tt.commit || caps.Degraded != tt.degraded {
+				t.Errorf("commit = %q, degraded = %t (%s), want %q, %t", caps.Commit, caps.Degraded, strings.Join(caps.Problems, "; "), tt.commit, tt.degraded)
+			}
+			if !reflect.DeepEqual(caps.Subcommands, []string{"apply-diffs", "hash-diffs"}) {
+				t.Errorf("subcommands = %q", caps.Subcommands)
+			}
+		})
+	}
+}
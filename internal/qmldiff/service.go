@@ -1,40 +1,170 @@
 package qmldiff
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/sandbox"
 )
 
+// waitDelay bounds how long a killed qmldiff may keep its output pipes open.
+const waitDelay = 5 * time.Second
+
+// maxCapturedOutput bounds how much of qmldiff's stdout and stderr is kept.
+const maxCapturedOutput = 1 << 20
+
+// scratchPrefix names the per-invocation working directories; the work
+// directory manager sweeps leftovers with this prefix.
+const scratchPrefix = "qmldiff-"
+
 type Service struct {
-	binaryPath string
+	binaryPath   string
+	limits       sandbox.Limits
+	scratchRoot  string
+	mu           sync.RWMutex
+	capabilities *Capabilities
 }
 
-func NewService(binaryPath string) *Service {
+// NewService returns a service running the qmldiff binary at binaryPath. Each
+// hash-diffs run gets limits and an empty working directory under
+// scratchRoot, or under the system temp directory if scratchRoot is empty.
+func NewService(binaryPath string, limits sandbox.Limits, scratchRoot string) *Service {
 	return &Service{
-		binaryPath: binaryPath,
+		binaryPath:  binaryPath,
+		limits:      limits,
+		scratchRoot: scratchRoot,
 	}
 }
 
-func (s *Service) HashDiffs(hashtabPath, qmdPath string) error {
-	cmd := exec.Command(s.binaryPath, "hash-diffs", hashtabPath, qmdPath)
+// HashDiffs hashes qmdPath in place. The qmldiff process is killed if ctx is
+// cancelled or its deadline passes. If qmldiff fails the error is an *Error
+// carrying the diagnostics parsed from its output.
+func (s *Service) HashDiffs(ctx context.Context, hashtabPath, qmdPath string) error {
+	return s.HashDiffsBatch(ctx, hashtabPath, []string{qmdPath})
+}
+
+// HashDiffsBatch hashes every file in qmdPaths in place with a single qmldiff
+// process, so the hashtab is only read once. An error means at least one file
+// failed; the files its diagnostics name are the ones known to have.
+func (s *Service) HashDiffsBatch(ctx context.Context, hashtabPath string, qmdPaths []string) error {
+	return s.run(ctx, "hash-diffs", append([]string{hashtabPath}, qmdPaths...))
+}
+
+// Verify checks the hashed file at qmdPath against hashtabPath with qmldiff
+// verify, which only some builds have; see Capabilities. If the check fails
+// the error is an *Error carrying the diagnostics.
+func (s *Service) Verify(ctx context.Context, hashtabPath, qmdPath string) error {
+	return s.run(ctx, "verify", []string{hashtabPath, qmdPath})
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// run runs qmldiff command in the sandbox with paths, made absolute, as its
+// arguments. The first path is the hashtab; the rest are QMD files.
+func (s *Service) run(ctx context.Context, command string, paths []string) error {
+	args := make([]string, 0, len(paths)+1)
+	args = append(args, command)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", p, err)
+		}
+		args = append(args, abs)
+	}
 
-	logging.Debug(logging.ComponentQMLDiff, "Running: %s hash-diffs %s %s", s.binaryPath, hashtabPath, qmdPath)
+	binary, err := s.resolveBinary()
+	if err != nil {
+		return err
+	}
 
-	err := cmd.Run()
+	scratch, err := os.MkdirTemp(s.scratchRoot, scratchPrefix+"*")
 	if err != nil {
-		return fmt.Errorf("hash-diffs failed: %w\nstderr: %s\nstdout: %s", err, stderr.String(), stdout.String())
+		return fmt.Errorf("failed to create qmldiff working directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	cmd := sandbox.Command(ctx, s.limits, scratch, binary, args...)
+	cmd.WaitDelay = waitDelay
+
+	stdout := &cappedBuffer{limit: maxCapturedOutput}
+	stderr := &cappedBuffer{limit: maxCapturedOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	logging.Debug(logging.ComponentQMLDiff, "Running: %s %s %s (%d file(s))", s.binaryPath, command, paths[0], len(paths)-1)
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s interrupted: %w", command, ctx.Err())
+	}
+	if err != nil {
+		qerr := &Error{
+			Command:     command,
+			Err:         err,
+			Stdout:      stdout.String(),
+			Stderr:      stderr.String(),
+			Diagnostics: ParseDiagnostics(stderr.String() + "\n" + stdout.String()),
+			Abnormal:    sandbox.Termination(cmd.ProcessState),
+		}
+		if qerr.Abnormal == "" && strings.Contains(qerr.Stderr, "memory allocation of") {
+			qerr.Abnormal = "memory limit exceeded"
+		}
+		if qerr.Abnormal != "" {
+			logging.Warn(logging.ComponentQMLDiff, "qmldiff terminated abnormally: %s", qerr.Abnormal)
+		}
+		logging.Debug(logging.ComponentQMLDiff, "%s failed: %v\nstderr: %s\nstdout: %s", command, err, qerr.Stderr, qerr.Stdout)
+		return qerr
 	}
 
 	return nil
 }
 
+// resolveBinary makes a relative binary path absolute, as qmldiff runs in its
+// own working directory. Bare names are left to be looked up in PATH.
+func (s *Service) resolveBinary() (string, error) {
+	if !strings.ContainsRune(s.binaryPath, filepath.Separator) {
+		return s.binaryPath, nil
+	}
+	abs, err := filepath.Abs(s.binaryPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve qmldiff binary: %w", err)
+	}
+	return abs, nil
+}
+
 func (s *Service) GetBinaryPath() string {
 	return s.binaryPath
 }
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a runaway process cannot exhaust the server's memory.
+type cappedBuffer struct {
+	buf       strings.Builder
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+			b.truncated = true
+		} else {
+			b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
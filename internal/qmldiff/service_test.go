@@ -0,0 +1,95 @@
+package qmldiff
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/sandbox"
+)
+
+// TestMain lets the test binary act as the sandbox wrapper that qmldiff is
+// started through, as the server binary does.
+func TestMain(m *testing.M) {
+	sandbox.RunHelper()
+	os.Exit(m.Run())
+}
+
+// writeScript writes a shell script to run in place of qmldiff.
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as the binary")
+	}
+	binary := filepath.Join(t.TempDir(), "qmldiff")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestHashDiffsKilledOnCancel(t *testing.T) {
+	scratch := t.TempDir()
+	s := NewService(writeScript(t, "exec sleep 30"), sandbox.Limits{}, scratch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := s.HashDiffs(ctx, "gcd", "a.qmd")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HashDiffs = %v, want it interrupted by the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > waitDelay {
+		t.Errorf("HashDiffs returned after %s, so qmldiff was not killed", elapsed)
+	}
+
+	if entries, _ := os.ReadDir(scratch); len(entries) != 0 {
+		t.Errorf("working directory left behind: %v", entries)
+	}
+}
+
+func TestHashDiffsReportsAbnormalTermination(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abnormal terminations are only told apart on Linux")
+	}
+
+	tests := []struct {
+		name     string
+		script   string
+		abnormal string
+	}{
+		{"rejected input", "echo \"error: unknown identifier 'footer'\" >&2; exit 1", ""},
+		{"crash", "kill -SEGV $$", "crashed (segmentation fault), possibly out of memory"},
+		{"allocation failure", "echo 'memory allocation of 4294967296 bytes failed' >&2; exit 134", "memory limit exceeded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(writeScript(t, tt.script), sandbox.Limits{}, t.TempDir())
+			err := s.HashDiffs(context.Background(), "gcd", "a.qmd")
+
+			var qerr *Error
+			if !errors.As(err, &qerr) {
+				t.Fatalf("HashDiffs = %v, want an *Error", err)
+			}
+			if qerr.Abnormal != tt.abnormal {
+				t.Errorf("Abnormal = %q, want %q", qerr.Abnormal, tt.abnormal)
+			}
+		})
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{limit: 4}
+	b.Write([]byte("abc"))
+	b.Write([]byte("def"))
+	b.Write([]byte("g"))
+	if got := b.String(); got != "abcd\n[output truncated]" {
+		t.Errorf("String = %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+// Package sandbox runs untrusted helper processes with resource limits.
+//
+// On Linux the server re-executes itself as a small wrapper that applies
+// rlimits and then execs the real command, so the limits apply to that
+// process alone. Elsewhere commands run without limits.
+package sandbox
+
+import (
+	"context"
+	"os/exec"
+)
+
+// helperArg is the first argument that makes the server binary act as the
+// limit-applying wrapper instead of starting the server.
+const helperArg = "__sandbox-exec"
+
+// Limits caps the resources of a sandboxed process. Zero leaves a resource
+// unlimited.
+type Limits struct {
+	// MemoryBytes caps the process's address space.
+	MemoryBytes uint64
+	// CPUSeconds caps the CPU time the process may use.
+	CPUSeconds uint64
+	// FileSizeBytes caps the size of any file the process writes.
+	FileSizeBytes uint64
+}
+
+// Command returns a command that runs name with args under limits in dir.
+// Run it like any other *exec.Cmd and pass its ProcessState to Termination
+// once it exits.
+func Command(ctx context.Context, limits Limits, dir, name string, args ...string) *exec.Cmd {
+	cmd := command(ctx, limits, name, args...)
+	cmd.Dir = dir
+	return cmd
+}
@@ -0,0 +1,108 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func command(ctx context.Context, limits Limits, name string, args ...string) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		return exec.CommandContext(ctx, name, args...)
+	}
+
+	helperArgs := []string{
+		helperArg,
+		strconv.FormatUint(limits.MemoryBytes, 10),
+		strconv.FormatUint(limits.CPUSeconds, 10),
+		strconv.FormatUint(limits.FileSizeBytes, 10),
+		name,
+	}
+	return exec.CommandContext(ctx, self, append(helperArgs, args...)...)
+}
+
+// RunHelper turns the current process into the sandbox wrapper if it was
+// started as one: it applies the limits and execs the real command, never
+// returning. Call it first thing in main.
+func RunHelper() {
+	if len(os.Args) < 6 || os.Args[1] != helperArg {
+		return
+	}
+
+	if err := runHelper(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func runHelper(args []string) error {
+	limits := make([]uint64, 3)
+	for i := range limits {
+		v, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q: %w", args[i], err)
+		}
+		limits[i] = v
+	}
+
+	// The hard CPU limit is a second above the soft one, so the process gets
+	// SIGXCPU, which Termination reports as such, before it is killed.
+	for _, l := range []struct {
+		resource int
+		value    uint64
+		slack    uint64
+	}{
+		{syscall.RLIMIT_AS, limits[0], 0},
+		{syscall.RLIMIT_CPU, limits[1], 1},
+		{syscall.RLIMIT_FSIZE, limits[2], 0},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		rlim := &syscall.Rlimit{Cur: l.value, Max: l.value + l.slack}
+		if err := syscall.Setrlimit(l.resource, rlim); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", l.resource, err)
+		}
+	}
+
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return fmt.Errorf("failed to disable core dumps: %w", err)
+	}
+
+	path, err := exec.LookPath(args[3])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args[3:], os.Environ())
+}
+
+// Termination describes why a process exited abnormally, or returns "" if it
+// exited normally, with any status.
+func Termination(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+
+	switch sig := status.Signal(); sig {
+	case syscall.SIGXCPU:
+		return "CPU time limit exceeded"
+	case syscall.SIGXFSZ:
+		return "output size limit exceeded"
+	case syscall.SIGKILL:
+		return "killed (CPU time or memory limit exceeded)"
+	case syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS:
+		return fmt.Sprintf("crashed (%s), possibly out of memory", sig)
+	default:
+		return fmt.Sprintf("terminated by signal %s", sig)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary act as the wrapper Command starts, as the
+// server binary does.
+func TestMain(m *testing.M) {
+	RunHelper()
+	os.Exit(m.Run())
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		limits      Limits
+		script      string
+		stdout      string
+		termination string
+	}{
+		{"working directory", Limits{}, "pwd", "<dir>", ""},
+		{"no core dumps", Limits{}, "ulimit -c", "0", ""},
+		{"failure is not abnormal", Limits{}, "exit 3", "", ""},
+		{"output size", Limits{FileSizeBytes: 1024}, "exec head -c 4096 /dev/zero > out", "", "output size limit exceeded"},
+		{"CPU time", Limits{CPUSeconds: 1}, "while :; do :; done", "", "CPU time limit exceeded"},
+		{"crash", Limits{}, "kill -SEGV $$", "", "crashed (segmentation fault), possibly out of memory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := Command(context.Background(), tt.limits, dir, "sh", "-c", tt.script)
+			out, _ := cmd.Output()
+
+			if want := strings.ReplaceAll(tt.stdout, "<dir>", dir); strings.TrimSpace(string(out)) != want {
+				t.Errorf("stdout = %q, want %q", out, want)
+			}
+			if got := Termination(cmd.ProcessState); got != tt.termination {
+				t.Errorf("Termination = %q, want %q", got, tt.termination)
+			}
+		})
+	}
+}
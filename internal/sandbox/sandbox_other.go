@@ -0,0 +1,30 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func command(ctx context.Context, limits Limits, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// RunHelper does nothing: limits are only applied on Linux.
+func RunHelper() {}
+
+// Termination describes why a process was killed by a signal, or returns ""
+// if it exited normally, with any status.
+func Termination(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return fmt.Sprintf("terminated by signal %s", status.Signal())
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package workdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+const (
+	inputPrefix  = "hash-input-"
+	outputPrefix = "hash-output-"
+	// scratchPrefix matches the working directories qmldiff runs in.
+	scratchPrefix = "qmldiff-"
+)
+
+// Manager owns the per-job input and output directories under a single root.
+// It deletes a job's output once the job expires and sweeps directories that
+// no job refers to, such as those left behind by a crash.
+type Manager struct {
+	root     string
+	store    *jobs.Store
+	interval time.Duration
+}
+
+func NewManager(root string, store *jobs.Store) (*Manager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve work directory: %w", err)
+	}
+
+	return &Manager{
+		root:     absRoot,
+		store:    store,
+		interval: time.Minute,
+	}, nil
+}
+
+func (m *Manager) Root() string {
+	return m.root
+}
+
+func (m *Manager) CreateInputDir() (string, error) {
+	return os.MkdirTemp(m.root, inputPrefix+"*")
+}
+
+func (m *Manager) CreateOutputDir() (string, error) {
+	return os.MkdirTemp(m.root, outputPrefix+"*")
+}
+
+// Remove deletes a job directory. Paths outside the root are refused so a
+// stale or corrupted job record can never delete unrelated files.
+func (m *Manager) Remove(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(absDir) != m.root {
+		return fmt.Errorf("refusing to remove %s: not inside work directory %s", dir, m.root)
+	}
+
+	return os.RemoveAll(absDir)
+}
+
+// Sweep removes every job directory under the root that no job in the store
+// refers to. Input directories are only used while a job runs, so at startup
+// all of them are orphans.
+func (m *Manager) Sweep() error {
+	inUse := make(map[string]bool)
+	for _, dir := range m.store.OutputDirs() {
+		if abs, err := filepath.Abs(dir); err == nil {
+			inUse[abs] = true
+		}
+	}
+
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return fmt.Errorf("failed to read work directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !(strings.HasPrefix(name, inputPrefix) || strings.HasPrefix(name, outputPrefix) || strings.HasPrefix(name, scratchPrefix)) {
+			continue
+		}
+
+		path := filepath.Join(m.root, name)
+		if inUse[path] {
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			logging.Warn(logging.ComponentJob, "Failed to remove orphaned directory %s: %v", path, err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		logging.Info(logging.ComponentJob, "Removed %d orphaned job directories from %s", removed, m.root)
+	}
+
+	return nil
+}
+
+// Start expires finished jobs in the background and deletes their output.
+func (m *Manager) Start() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.expire(time.Now())
+		}
+	}()
+}
+
+func (m *Manager) expire(now time.Time) {
+	for _, job := range m.store.RemoveExpired(now) {
+		if err := m.Remove(job.OutputDir); err != nil {
+			logging.Warn(logging.ComponentJob, "Failed to remove output of expired job: %v", err)
+		}
+	}
+}
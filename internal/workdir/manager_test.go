@@ -0,0 +1,113 @@
+package workdir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
+)
+
+func newTestManager(t *testing.T) (*Manager, *jobs.Store) {
+	t.Helper()
+	store, err := jobs.NewStore(jobs.MemoryBackend{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	m, err := NewManager(t.TempDir(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, store
+}
+
+func mkdirs(t *testing.T, root string, names ...string) []string {
+	t.Helper()
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(root, name)
+		if err := os.Mkdir(paths[i], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSweepRemovesOrphans(t *testing.T) {
+	m, store := newTestManager(t)
+
+	kept := mkdirs(t, m.Root(), "hash-output-job", "uploads")
+	orphans := mkdirs(t, m.Root(), "hash-output-old", "hash-input-old", "qmldiff-old")
+	store.Create("job", "hash", 1)
+	store.SetOutputDir("job", kept[0])
+
+	if err := m.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range kept {
+		if !exists(path) {
+			t.Errorf("%s was swept", filepath.Base(path))
+		}
+	}
+	for _, path := range orphans {
+		if exists(path) {
+			t.Errorf("orphaned %s was kept", filepath.Base(path))
+		}
+	}
+}
+
+func TestExpireRemovesOutput(t *testing.T) {
+	m, store := newTestManager(t)
+
+	dirs := mkdirs(t, m.Root(), "hash-output-done", "hash-output-running")
+	store.Create("done", "hash", 1)
+	store.SetOutputDir("done", dirs[0])
+	store.Update("done", "success", "Hashed 1 file(s)", nil)
+	store.Create("running", "hash", 1)
+	store.SetOutputDir("running", dirs[1])
+	store.Update("running", "running", "Hashing files", nil)
+
+	done, _ := store.Snapshot("done")
+	if done.ExpiresAt == nil {
+		t.Fatal("finished job has no expiry")
+	}
+
+	m.expire(done.ExpiresAt.Add(-time.Second))
+	if !exists(dirs[0]) {
+		t.Error("output removed before the job expired")
+	}
+
+	m.expire(done.ExpiresAt.Add(time.Second))
+	if exists(dirs[0]) {
+		t.Error("output of the expired job was kept")
+	}
+	if _, ok := store.Get("done"); ok {
+		t.Error("expired job is still in the store")
+	}
+	if !exists(dirs[1]) {
+		t.Error("output of the running job was removed")
+	}
+}
+
+func TestRemoveStaysInsideRoot(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	outside := t.TempDir()
+	if err := m.Remove(outside); err == nil {
+		t.Error("Remove of a directory outside the root succeeded")
+	}
+	if !exists(outside) {
+		t.Error("directory outside the root was removed")
+	}
+	if err := m.Remove(""); err != nil {
+		t.Errorf("Remove of no directory = %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"syscall"
 	"time"
 
@@ -17,10 +19,13 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/config"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/handlers"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/hasher"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/jobs"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/qmldiff"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/sandbox"
 	"github.com/rmitchellscott/rm-qmd-hasher/internal/version"
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/workdir"
 	"github.com/rmitchellscott/rm-qmd-hasher/pkg/gcdcache"
 	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
 )
@@ -30,6 +35,8 @@ import (
 var embeddedUI embed.FS
 
 func main() {
+	sandbox.RunHelper()
+
 	if err := godotenv.Load(); err != nil {
 		logging.Info(logging.ComponentStartup, "No .env file found, using environment variables")
 	}
@@ -39,37 +46,89 @@ func main() {
 	hashtabDir := config.Get("HASHTAB_DIR", "./hashtables")
 	logging.Info(logging.ComponentStartup, "Loading hashtables from: %s", hashtabDir)
 
-	hashtabService, err := hashtab.NewService(hashtabDir)
+	hashtab.SetMmap(config.GetBool("HASHTAB_MMAP", false))
+
+	loadWorkers := config.GetInt("HASHTAB_LOAD_WORKERS", runtime.NumCPU())
+	hashtabService, err := hashtab.NewService(hashtabDir, loadWorkers)
 	if err != nil {
 		logging.Error(logging.ComponentStartup, "Failed to initialize hashtab service: %v", err)
 		os.Exit(1)
 	}
 
-	hashtables := hashtabService.GetHashtables()
-	logging.Info(logging.ComponentStartup, "Loaded %d hashtables", len(hashtables))
-
-	versions := hashtabService.GetVersions()
-	for _, v := range versions {
-		logging.Info(logging.ComponentStartup, "  - %s (%d devices: %v)", v.Version, v.DeviceCount, v.Devices)
-	}
+	workDir := config.Get("WORK_DIR", filepath.Join(os.TempDir(), "rm-qmd-hasher"))
 
 	qmldiffBinary := config.Get("QMLDIFF_BINARY", "./qmldiff")
-	qmldiffService := qmldiff.NewService(qmldiffBinary)
-	logging.Info(logging.ComponentStartup, "Initialized qmldiff service (binary: %s)", qmldiffBinary)
+	qmldiffLimits := sandbox.Limits{
+		MemoryBytes:   uint64(config.GetInt("QMLDIFF_MEMORY_LIMIT_MB", 1024)) << 20,
+		CPUSeconds:    uint64(config.GetDuration("QMLDIFF_CPU_LIMIT", 2*time.Minute) / time.Second),
+		FileSizeBytes: uint64(config.GetInt("QMLDIFF_OUTPUT_LIMIT_MB", 64)) << 20,
+	}
+	qmldiffService := qmldiff.NewService(qmldiffBinary, qmldiffLimits, workDir)
+	logging.Info(logging.ComponentStartup, "Initialized qmldiff service (binary: %s, limits: %d MB memory, %ds CPU, %d MB output)", qmldiffBinary, qmldiffLimits.MemoryBytes>>20, qmldiffLimits.CPUSeconds, qmldiffLimits.FileSizeBytes>>20)
 
 	gcdDir := config.Get("GCD_HASHTAB_DIR", "./gcd-hashtabs")
-	gcdCache, err := gcdcache.NewService(gcdDir, qmldiffBinary, hashtabService)
+	gcdLimits := gcdcache.Limits{
+		MaxVersions: config.GetInt("GCD_MAX_VERSIONS", 12),
+		MaxDevices:  config.GetInt("GCD_MAX_DEVICES", 8),
+		MaxCached:   config.GetInt("GCD_MAX_CACHED", 32),
+	}
+	gcdCache, err := gcdcache.NewService(gcdDir, hashtabService, loadWorkers, gcdLimits)
 	if err != nil {
 		logging.Error(logging.ComponentStartup, "Failed to initialize GCD cache: %v", err)
 		os.Exit(1)
 	}
 
-	logging.Info(logging.ComponentStartup, "Generating GCD hashtabs on startup...")
-	if err := gcdCache.GenerateAll(); err != nil {
-		logging.Warn(logging.ComponentStartup, "Some GCD hashtabs failed to generate: %v", err)
+	hashBackend, err := hasher.New(config.Get("HASH_BACKEND", "qmldiff"), qmldiffService, config.GetInt("QMLDIFF_BATCH_SIZE", 50), hashtabService, gcdCache)
+	if err != nil {
+		logging.Error(logging.ComponentStartup, "Failed to initialize hash backend: %v", err)
+		os.Exit(1)
+	}
+	logging.Info(logging.ComponentStartup, "Hash backend: %s", hashBackend.Name())
+
+	if hashBackend.Name() == "qmldiff" {
+		qmldiffCaps := qmldiffService.Probe(context.Background(), config.Get("QMLDIFF_EXPECTED_VERSION", ""), config.Get("QMLDIFF_COMMIT", ""))
+		if qmldiffCaps.Degraded && config.GetBool("QMLDIFF_STRICT", false) {
+			logging.Error(logging.ComponentStartup, "qmldiff binary check failed and QMLDIFF_STRICT is set, refusing to start")
+			os.Exit(1)
+		}
+	}
+
+	var jobBackend jobs.Backend
+	switch backend := config.Get("JOB_STORE", "bolt"); backend {
+	case "memory":
+		logging.Info(logging.ComponentStartup, "Job store: in-memory (jobs are lost on restart)")
+		jobBackend = jobs.MemoryBackend{}
+	case "bolt":
+		jobDBPath := config.Get("JOB_STORE_PATH", "./data/jobs.db")
+		logging.Info(logging.ComponentStartup, "Job store: %s", jobDBPath)
+		jobBackend, err = jobs.NewBoltBackend(jobDBPath)
+		if err != nil {
+			logging.Error(logging.ComponentStartup, "Failed to open job store: %v", err)
+			os.Exit(1)
+		}
+	default:
+		logging.Error(logging.ComponentStartup, "Unknown JOB_STORE backend: %s", backend)
+		os.Exit(1)
 	}
 
-	jobStore := jobs.NewStore()
+	jobTTL := config.GetDuration("JOB_TTL", 10*time.Minute)
+	jobStore, err := jobs.NewStore(jobBackend, jobTTL)
+	if err != nil {
+		logging.Error(logging.ComponentStartup, "Failed to load job store: %v", err)
+		os.Exit(1)
+	}
+	defer jobStore.Close()
+
+	workdirs, err := workdir.NewManager(workDir, jobStore)
+	if err != nil {
+		logging.Error(logging.ComponentStartup, "Failed to initialize work directory: %v", err)
+		os.Exit(1)
+	}
+	logging.Info(logging.ComponentStartup, "Work directory: %s (job results kept for %s)", workdirs.Root(), jobTTL)
+	if err := workdirs.Sweep(); err != nil {
+		logging.Warn(logging.ComponentStartup, "Failed to sweep work directory: %v", err)
+	}
+	workdirs.Start()
 
 	r := chi.NewRouter()
 
@@ -79,17 +138,35 @@ func main() {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	apiHandler := handlers.NewAPIHandler(qmldiffService, gcdCache, jobStore)
+	jobWorkers := config.GetInt("JOB_WORKERS", runtime.NumCPU())
+	jobQueueSize := config.GetInt("JOB_QUEUE_SIZE", 100)
+	jobQueue := jobs.NewQueue(jobStore, jobWorkers, jobQueueSize)
+	logging.Info(logging.ComponentStartup, "Job queue: %d workers, up to %d queued jobs", jobWorkers, jobQueueSize)
+
+	jobTimeout := config.GetDuration("JOB_TIMEOUT", 10*time.Minute)
+	apiHandler := handlers.NewAPIHandler(hashBackend, jobStore, jobQueue, workdirs, jobTimeout)
+	r.Get("/readyz", apiHandler.Ready)
 	r.Route("/api", func(r chi.Router) {
 		r.Post("/hash", apiHandler.Hash)
+		r.Post("/unhash", apiHandler.Unhash)
+		r.Post("/migrate", apiHandler.Migrate)
+		r.Post("/compatibility", apiHandler.Compatibility)
 		r.Get("/versions", apiHandler.ListVersions)
+		r.Get("/gcd", apiHandler.GCDReport)
+		r.Get("/hashtabs", apiHandler.ListHashtabs)
+		r.Get("/hashtabs/lookup", apiHandler.LookupHashtabs)
 		r.Get("/results/{jobId}", apiHandler.GetResults)
+		r.Delete("/jobs/{jobId}", apiHandler.CancelJob)
 		r.Get("/download/{jobId}", apiHandler.Download)
 		r.Get("/status/ws/{jobId}", handlers.StatusWSHandler(jobStore))
 		r.Get("/version", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(version.Get())
+			json.NewEncoder(w).Encode(struct {
+				version.Info
+				HashBackend string                `json:"hashBackend"`
+				Qmldiff     *qmldiff.Capabilities `json:"qmldiff"`
+			}{version.Get(), hashBackend.Name(), qmldiffService.Capabilities()})
 		})
 	})
 
@@ -128,12 +205,53 @@ func main() {
 		}
 	}()
 
+	// Hashtabs are loaded after the listener is up so the container answers
+	// health checks meanwhile; /readyz reports when loading is done.
+	watch := config.GetBool("HASHTAB_WATCH", true)
+	stopWatch := make(chan func(), 1)
+	go func() {
+		// The watcher starts first so files added during the initial scan and
+		// GCD generation are not missed.
+		if watch {
+			stop, err := hashtabService.Watch()
+			if err != nil {
+				logging.Warn(logging.ComponentStartup, "Failed to watch hashtab directory, falling back to polling: %v", err)
+			} else {
+				stopWatch <- stop
+			}
+		}
+
+		logging.Info(logging.ComponentStartup, "Loading hashtables with %d workers", loadWorkers)
+		if err := hashtabService.LoadAll(); err != nil {
+			logging.Error(logging.ComponentStartup, "Failed to load hashtables: %v", err)
+		}
+
+		hashtables := hashtabService.GetHashtables()
+		logging.Info(logging.ComponentStartup, "Loaded %d hashtables", len(hashtables))
+
+		for _, v := range hashtabService.GetVersions() {
+			logging.Info(logging.ComponentStartup, "  - %s (%d devices: %v)", v.Version, v.DeviceCount, v.Devices)
+		}
+
+		logging.Info(logging.ComponentStartup, "Generating GCD hashtabs on startup...")
+		if err := gcdCache.GenerateAll(); err != nil {
+			logging.Warn(logging.ComponentStartup, "Some GCD hashtabs failed to generate: %v", err)
+		}
+		logging.Info(logging.ComponentStartup, "Ready")
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 
 	logging.Info(logging.ComponentServer, "Shutting down server...")
 
+	select {
+	case stop := <-stopWatch:
+		stop()
+	default:
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -1,9 +1,15 @@
 package gcdcache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,160 +19,652 @@ import (
 
 type GCDHashtab struct {
 	Version       string
+	Versions      []string
+	Devices       []string
 	Path          string
 	SourceModTime time.Time
 	DeviceCount   int
+	Entries       int
+	Dropped       map[string]int
+	// Excluded and ExcludedCounts are only set for cross-version GCDs.
+	Excluded       []ExcludedEntry
+	ExcludedCounts map[string]int
+	// requestedDevices is the device subset the GCD was asked for, nil for all.
+	requestedDevices []string
+	// lastUsed orders non-default GCDs for eviction.
+	lastUsed uint64
 }
 
+// Limits bounds the GCDs clients can have built. Zero means unlimited.
+type Limits struct {
+	// MaxVersions is the most versions one GCD may span.
+	MaxVersions int
+	// MaxDevices is the most devices a GCD may be restricted to.
+	MaxDevices int
+	// MaxCached is how many GCDs other than the default GCD of each version
+	// are kept; the least recently used that are not in use are deleted
+	// beyond that.
+	MaxCached int
+}
+
+// ErrLimitExceeded is returned for a GCD request outside the service's Limits.
+var ErrLimitExceeded = errors.New("GCD request exceeds limits")
+
 type Service struct {
 	gcdDir         string
-	qmldiffBinary  string
 	hashtabService *hashtab.Service
 	gcdHashtabs    map[string]*GCDHashtab
 	sourceModTimes map[string]map[string]time.Time
-	mu             sync.RWMutex
+	workers        int
+	limits         Limits
+	useCounter     uint64
+	generated      bool
+	// building counts, by path, the GCD files being generated or reused
+	// that are not stored yet, so sweep leaves them alone.
+	building map[string]int
+	// pinned counts, by path, the GCDs handed out that have not been
+	// released, so eviction leaves their files alone.
+	pinned map[string]int
+	mu     sync.RWMutex
 }
 
-func NewService(gcdDir, qmldiffBinary string, hashtabService *hashtab.Service) (*Service, error) {
+// NewService creates a GCD cache over hashtabService. GenerateAll builds the
+// GCDs of up to workers versions at once.
+func NewService(gcdDir string, hashtabService *hashtab.Service, workers int, limits Limits) (*Service, error) {
 	if err := os.MkdirAll(gcdDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create GCD hashtab directory: %w", err)
 	}
 
 	service := &Service{
 		gcdDir:         gcdDir,
-		qmldiffBinary:  qmldiffBinary,
 		hashtabService: hashtabService,
 		gcdHashtabs:    make(map[string]*GCDHashtab),
 		sourceModTimes: make(map[string]map[string]time.Time),
+		workers:        max(workers, 1),
+		limits:         limits,
+		building:       make(map[string]int),
+		pinned:         make(map[string]int),
 	}
+	hashtabService.OnReload(service.Regenerate)
 
 	return service, nil
 }
 
+// GenerateAll generates the default GCD of every loaded version, newest
+// first, using up to s.workers goroutines.
 func (s *Service) GenerateAll() error {
+	defer func() {
+		s.mu.Lock()
+		s.generated = true
+		s.mu.Unlock()
+	}()
+
 	versions := s.hashtabService.GetVersions()
 	logging.Info(logging.ComponentGCD, "Generating GCD hashtabs for %d versions", len(versions))
 
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < min(s.workers, len(versions)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for version := range work {
+				if err := s.generateGCD([]string{version}, nil); err != nil {
+					logging.Error(logging.ComponentGCD, "Failed to generate GCD for version %s: %v", version, err)
+				}
+			}
+		}()
+	}
+
 	for _, v := range versions {
-		if err := s.generateGCD(v.Version); err != nil {
-			logging.Error(logging.ComponentGCD, "Failed to generate GCD for version %s: %v", v.Version, err)
-		}
+		work <- v.Version
 	}
+	close(work)
+	wg.Wait()
+
+	s.sweep()
 
 	return nil
 }
 
-func (s *Service) generateGCD(version string) error {
+// sweep deletes the GCD files in the directory that no cached GCD uses, such
+// as GCDs requested before a restart, so the directory does not grow without
+// bound. It holds the lock throughout, so a GCD generated on demand meanwhile
+// is either already building or not written yet.
+func (s *Service) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inUse := make(map[string]bool, len(s.gcdHashtabs))
+	for _, gcd := range s.gcdHashtabs {
+		inUse[gcd.Path] = true
+	}
+
+	entries, err := os.ReadDir(s.gcdDir)
+	if err != nil {
+		logging.Warn(logging.ComponentGCD, "Failed to read GCD directory: %v", err)
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".gcd") {
+			continue
+		}
+		path := filepath.Join(s.gcdDir, name)
+		if inUse[path] || s.building[path] > 0 || s.pinned[path] > 0 {
+			continue
+		}
+		os.Remove(manifestPath(path))
+		if err := os.Remove(path); err != nil {
+			logging.Warn(logging.ComponentGCD, "Failed to remove unused GCD %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		logging.Info(logging.ComponentGCD, "Removed %d unused GCD hashtab(s) from %s", removed, s.gcdDir)
+	}
+}
+
+// Ready reports whether GenerateAll has finished.
+func (s *Service) Ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.generated
+}
+
+// Generating reports whether the default GCD of version is still waiting to
+// be generated by GenerateAll.
+func (s *Service) Generating(version string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.generated {
+		return false
+	}
+	_, ok := s.gcdHashtabs[gcdKey([]string{version}, nil)]
+	return !ok
+}
+
+// Regenerate rebuilds the GCDs that include any of versions, after their
+// hashtabs were reloaded, and generates the default GCD of versions that are
+// new. GCDs of versions that no longer have hashtabs are dropped.
+func (s *Service) Regenerate(versions []string) {
+	changed := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		changed[v] = true
+	}
+
+	type target struct {
+		key      string
+		versions []string
+		devices  []string
+	}
+
+	s.mu.RLock()
+	var targets []target
+	for key, gcd := range s.gcdHashtabs {
+		for _, v := range gcd.Versions {
+			if changed[v] {
+				targets = append(targets, target{key, gcd.Versions, gcd.requestedDevices})
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	regenerated := make(map[string]bool)
+	for _, t := range targets {
+		if err := s.generateGCD(t.versions, t.devices); err != nil {
+			logging.Warn(logging.ComponentGCD, "Dropping GCD for %s: %v", gcdLabel(t.versions, t.devices), err)
+			s.mu.Lock()
+			delete(s.gcdHashtabs, t.key)
+			delete(s.sourceModTimes, t.key)
+			s.mu.Unlock()
+			continue
+		}
+		regenerated[t.key] = true
+	}
+
+	for _, v := range versions {
+		key := gcdKey([]string{v}, nil)
+		if regenerated[key] || len(s.hashtabService.GetHashtabsForVersion(v)) == 0 {
+			continue
+		}
+		if err := s.generateGCD([]string{v}, nil); err != nil {
+			logging.Error(logging.ComponentGCD, "Failed to generate GCD for version %s: %v", v, err)
+		}
+	}
+}
+
+// gcdKey identifies a GCD by its versions and device subset, and names its
+// files. It is a digest of both, so a GCD spanning a wide version range still
+// gets a short filename; gcdLabel is the readable form used in logs and
+// manifests. A nil subset means every device of each version.
+func gcdKey(versions []string, devices []string) string {
+	h := sha256.New()
+	io.WriteString(h, strings.Join(versions, "\n"))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, strings.Join(devices, "\n"))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// gcdLabel names a GCD by its versions and, when restricted, its devices,
+// e.g. "3.22.0.64+3.24.0.149_rmpp-rmppm".
+func gcdLabel(versions []string, devices []string) string {
+	label := strings.Join(versions, "+")
+	if len(devices) == 0 {
+		return label
+	}
+	return label + "_" + strings.Join(devices, "-")
+}
+
+// normalizeVersions orders versions ascending and de-duplicates them.
+func normalizeVersions(versions []string) []string {
+	seen := make(map[string]bool, len(versions))
+	result := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return hashtab.CompareVersions(result[i], result[j]) < 0
+	})
+	return result
+}
+
+// normalizeDevices sorts and de-duplicates a device subset.
+func normalizeDevices(devices []string) []string {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(devices))
+	result := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if d == "" || seen[d] {
+			continue
+		}
+		seen[d] = true
+		result = append(result, d)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// selectHashtabs returns the hashtabs of every version restricted to devices.
+// It fails if any requested device has no hashtab for one of the versions.
+func (s *Service) selectHashtabs(versions []string, devices []string) ([]*hashtab.Hashtab, error) {
+	var selected []*hashtab.Hashtab
+	for _, version := range versions {
+		hashtabs, err := s.selectVersionHashtabs(version, devices)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, hashtabs...)
+	}
+	return selected, nil
+}
+
+func (s *Service) selectVersionHashtabs(version string, devices []string) ([]*hashtab.Hashtab, error) {
 	hashtabs := s.hashtabService.GetHashtabsForVersion(version)
 	if len(hashtabs) == 0 {
-		return fmt.Errorf("no hashtabs found for version %s", version)
+		return nil, fmt.Errorf("no hashtabs found for version %s", version)
+	}
+
+	if len(devices) == 0 {
+		return hashtabs, nil
+	}
+
+	byDevice := make(map[string]*hashtab.Hashtab, len(hashtabs))
+	for _, ht := range hashtabs {
+		byDevice[ht.Device] = ht
+	}
+
+	selected := make([]*hashtab.Hashtab, 0, len(devices))
+	for _, d := range devices {
+		ht, ok := byDevice[d]
+		if !ok {
+			return nil, fmt.Errorf("device %s not available for version %s", d, version)
+		}
+		selected = append(selected, ht)
 	}
 
+	return selected, nil
+}
+
+func (s *Service) generateGCD(versions []string, devices []string) error {
+	hashtabs, err := s.selectHashtabs(versions, devices)
+	if err != nil {
+		return err
+	}
+
+	key := gcdKey(versions, devices)
+	label := gcdLabel(versions, devices)
+
 	if len(hashtabs) == 1 {
-		logging.Info(logging.ComponentGCD, "Only one device hashtab for version %s, using it directly", version)
+		logging.Info(logging.ComponentGCD, "Only one device hashtab for %s, using it directly", label)
+		s.storeGCD(key, &GCDHashtab{
+			Versions: versions,
+			Path:     hashtabs[0].Path,
+			Entries:  hashtabs[0].Len(),
+		}, hashtabs)
+		return nil
+	}
+
+	outputPath := filepath.Join(s.gcdDir, key+".gcd")
+
+	s.mu.Lock()
+	s.building[outputPath]++
+	s.mu.Unlock()
+	defer func() {
 		s.mu.Lock()
-		s.gcdHashtabs[version] = &GCDHashtab{
-			Version:       version,
-			Path:          hashtabs[0].Path,
-			SourceModTime: time.Now(),
-			DeviceCount:   1,
-		}
-		s.sourceModTimes[version] = map[string]time.Time{
-			hashtabs[0].Path: time.Now(),
+		if s.building[outputPath]--; s.building[outputPath] == 0 {
+			delete(s.building, outputPath)
 		}
 		s.mu.Unlock()
-		return nil
+	}()
+
+	sources := describeSources(hashtabs)
+
+	if manifest, err := loadManifest(manifestPath(outputPath)); err == nil && manifest.matches(sources) {
+		if !manifest.describes(outputPath) {
+			logging.Warn(logging.ComponentGCD, "GCD hashtab for %s is missing or does not match its manifest, regenerating", label)
+		} else {
+			logging.Info(logging.ComponentGCD, "Reusing GCD hashtab for %s (sources unchanged since %s)", label, manifest.GeneratedAt.Format(time.RFC3339))
+			s.storeGCD(key, &GCDHashtab{
+				Versions:       versions,
+				Path:           outputPath,
+				Entries:        manifest.Entries,
+				Dropped:        manifest.Dropped,
+				Excluded:       manifest.Excluded,
+				ExcludedCounts: manifest.ExcludedCounts,
+			}, hashtabs)
+			return nil
+		}
 	}
 
-	outputPath := filepath.Join(s.gcdDir, version+".gcd")
+	logging.Info(logging.ComponentGCD, "Generating GCD hashtab for %s from %d device hashtabs", label, len(hashtabs))
 
-	args := []string{"gcd-hashtab", outputPath}
-	for _, ht := range hashtabs {
-		args = append(args, ht.Path)
+	gcd := Intersect(hashtabs)
+	if err := gcd.Save(outputPath); err != nil {
+		return fmt.Errorf("failed to write GCD hashtab: %w", err)
+	}
+	written, err := describeFile(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read back GCD hashtab: %w", err)
 	}
 
-	logging.Info(logging.ComponentGCD, "Generating GCD hashtab for version %s from %d device hashtabs", version, len(hashtabs))
+	result := &GCDHashtab{
+		Versions: versions,
+		Path:     outputPath,
+		Entries:  len(gcd.Entries),
+		Dropped:  gcd.Dropped,
+	}
 
-	if err := runQmldiff(s.qmldiffBinary, args...); err != nil {
-		return fmt.Errorf("qmldiff gcd-hashtab failed: %w", err)
+	if len(versions) > 1 {
+		result.Dropped = nil
+		result.Excluded, result.ExcludedCounts = excludedEntries(versions, hashtabs, gcd.Entries)
+		for _, v := range versions {
+			logging.Info(logging.ComponentGCD, "  - %s: %d entries excluded", v, result.ExcludedCounts[v])
+		}
+	} else {
+		for _, ht := range hashtabs {
+			logging.Info(logging.ComponentGCD, "  - %s: %d of %d entries dropped", ht.Device, gcd.Dropped[ht.Device], ht.Len())
+		}
 	}
 
-	s.mu.Lock()
-	s.gcdHashtabs[version] = &GCDHashtab{
-		Version:       version,
-		Path:          outputPath,
-		SourceModTime: time.Now(),
-		DeviceCount:   len(hashtabs),
+	manifest := &Manifest{
+		Version:        label,
+		Versions:       versions,
+		Devices:        devices,
+		Generator:      generatorVersion,
+		GeneratedAt:    time.Now(),
+		Entries:        result.Entries,
+		Dropped:        result.Dropped,
+		Excluded:       result.Excluded,
+		ExcludedCounts: result.ExcludedCounts,
+		Sources:        sources,
+		Size:           written.Size,
+		SHA256:         written.SHA256,
+	}
+	if err := manifest.save(manifestPath(outputPath)); err != nil {
+		logging.Warn(logging.ComponentGCD, "Failed to write manifest for %s: %v", label, err)
 	}
 
+	s.storeGCD(key, result, hashtabs)
+
+	logging.Info(logging.ComponentGCD, "Generated GCD hashtab for %s at %s (%d entries)", label, outputPath, len(gcd.Entries))
+
+	return nil
+}
+
+// storeGCD fills in the fields of gcd derived from its source hashtabs and
+// records it under key.
+func (s *Service) storeGCD(key string, gcd *GCDHashtab, hashtabs []*hashtab.Hashtab) {
 	modTimes := make(map[string]time.Time)
+	seen := make(map[string]bool)
+	devices := make([]string, 0, len(hashtabs))
 	for _, ht := range hashtabs {
 		if info, err := os.Stat(ht.Path); err == nil {
 			modTimes[ht.Path] = info.ModTime()
 		}
+		if !seen[ht.Device] {
+			seen[ht.Device] = true
+			devices = append(devices, ht.Device)
+		}
 	}
-	s.sourceModTimes[version] = modTimes
-	s.mu.Unlock()
+	sort.Strings(devices)
 
-	logging.Info(logging.ComponentGCD, "Generated GCD hashtab for version %s at %s", version, outputPath)
+	gcd.Version = strings.Join(gcd.Versions, "+")
+	gcd.Devices = devices
+	if key != gcdKey(gcd.Versions, nil) {
+		gcd.requestedDevices = devices
+	}
+	gcd.SourceModTime = time.Now()
+	gcd.DeviceCount = len(hashtabs)
 
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A fresh GCD counts as just used, so it is not the first evicted
+	// before its requester pins it.
+	s.useCounter++
+	gcd.lastUsed = s.useCounter
+	s.gcdHashtabs[key] = gcd
+	s.sourceModTimes[key] = modTimes
 }
 
+// GetGCDHashtab returns the path of the GCD hashtab covering every device of
+// version. Default GCDs are never evicted, so the path is not pinned.
 func (s *Service) GetGCDHashtab(version string) (string, error) {
-	reloaded, err := s.hashtabService.CheckAndReload()
+	gcd, err := s.GetGCDHashtabForDevices(version, nil)
 	if err != nil {
+		return "", err
+	}
+	s.Release(gcd)
+	return gcd.Path, nil
+}
+
+// GetGCDHashtabForDevices returns the GCD hashtab for a subset of the devices
+// of version, generating it on first use. An empty subset selects every device.
+// Release it once it is no longer used.
+func (s *Service) GetGCDHashtabForDevices(version string, devices []string) (*GCDHashtab, error) {
+	return s.GetGCDHashtabForVersions([]string{version}, devices)
+}
+
+// GetGCDHashtabForVersions returns a GCD hashtab valid on every listed
+// version and device. With more than one version the result also reports the
+// entries that fell out of the intersection. The GCD's file is not evicted
+// until the GCD is passed to Release.
+func (s *Service) GetGCDHashtabForVersions(versions []string, devices []string) (*GCDHashtab, error) {
+	versions = normalizeVersions(versions)
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions requested")
+	}
+	devices = normalizeDevices(devices)
+	if err := s.CheckLimits(versions, devices); err != nil {
+		return nil, err
+	}
+	key := gcdKey(versions, devices)
+
+	// A reload regenerates affected GCDs through Regenerate.
+	if _, err := s.hashtabService.CheckAndReload(); err != nil {
 		logging.Warn(logging.ComponentGCD, "Failed to check hashtab reload: %v", err)
 	}
 
-	if reloaded {
-		if err := s.generateGCD(version); err != nil {
-			return "", err
-		}
-	} else {
-		needsRegen := false
+	needsRegen := false
 
-		s.mu.RLock()
-		gcd, exists := s.gcdHashtabs[version]
-		sourceMods := s.sourceModTimes[version]
-		s.mu.RUnlock()
+	s.mu.RLock()
+	gcd, exists := s.gcdHashtabs[key]
+	sourceMods := s.sourceModTimes[key]
+	s.mu.RUnlock()
 
-		if !exists {
+	if !exists {
+		needsRegen = true
+	} else {
+		hashtabs, err := s.selectHashtabs(versions, devices)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashtabs) != gcd.DeviceCount {
 			needsRegen = true
 		} else {
-			hashtabs := s.hashtabService.GetHashtabsForVersion(version)
-			if len(hashtabs) != gcd.DeviceCount {
-				needsRegen = true
-			} else {
-				for _, ht := range hashtabs {
-					if info, err := os.Stat(ht.Path); err == nil {
-						if oldMod, ok := sourceMods[ht.Path]; !ok || !oldMod.Equal(info.ModTime()) {
-							needsRegen = true
-							break
-						}
+			for _, ht := range hashtabs {
+				if info, err := os.Stat(ht.Path); err == nil {
+					if oldMod, ok := sourceMods[ht.Path]; !ok || !oldMod.Equal(info.ModTime()) {
+						needsRegen = true
+						break
 					}
 				}
 			}
 		}
+	}
 
-		if needsRegen {
-			if err := s.generateGCD(version); err != nil {
-				return "", err
-			}
+	if needsRegen {
+		if err := s.generateGCD(versions, devices); err != nil {
+			return nil, err
 		}
 	}
 
-	s.mu.RLock()
-	gcd, exists := s.gcdHashtabs[version]
-	s.mu.RUnlock()
+	s.mu.Lock()
+	gcd, exists = s.gcdHashtabs[key]
+	if exists {
+		s.useCounter++
+		gcd.lastUsed = s.useCounter
+		s.pinned[gcd.Path]++
+	}
+	evicted := s.evictLocked()
+	s.mu.Unlock()
+
+	s.removeFiles(evicted)
 
 	if !exists {
-		return "", fmt.Errorf("GCD hashtab not found for version %s", version)
+		return nil, fmt.Errorf("GCD hashtab not found for %s", gcdLabel(versions, devices))
 	}
 
-	return gcd.Path, nil
+	return gcd, nil
+}
+
+// Release marks a GCD returned by GetGCDHashtabForVersions as no longer in
+// use, so its file may be evicted.
+func (s *Service) Release(gcd *GCDHashtab) {
+	s.mu.Lock()
+	if s.pinned[gcd.Path]--; s.pinned[gcd.Path] <= 0 {
+		delete(s.pinned, gcd.Path)
+	}
+	evicted := s.evictLocked()
+	s.mu.Unlock()
+
+	s.removeFiles(evicted)
+}
+
+// CheckLimits reports whether a GCD for versions and devices may be built,
+// returning an error wrapping ErrLimitExceeded if not. Duplicates are not
+// counted.
+func (s *Service) CheckLimits(versions []string, devices []string) error {
+	versions = normalizeVersions(versions)
+	devices = normalizeDevices(devices)
+
+	if s.limits.MaxVersions > 0 && len(versions) > s.limits.MaxVersions {
+		return fmt.Errorf("%w: %d versions requested, at most %d allowed", ErrLimitExceeded, len(versions), s.limits.MaxVersions)
+	}
+	if s.limits.MaxDevices > 0 && len(devices) > s.limits.MaxDevices {
+		return fmt.Errorf("%w: %d devices requested, at most %d allowed", ErrLimitExceeded, len(devices), s.limits.MaxDevices)
+	}
+	return nil
+}
+
+// isDefault reports whether gcd is the default GCD of a single version, which
+// is kept for as long as the version is loaded.
+func (gcd *GCDHashtab) isDefault() bool {
+	return len(gcd.Versions) == 1 && gcd.requestedDevices == nil
+}
+
+// evictLocked drops the least recently used non-default GCDs beyond
+// s.limits.MaxCached and returns them so their files can be removed. GCDs
+// that are pinned stay, even if that keeps more than MaxCached; they are
+// evicted once released.
+func (s *Service) evictLocked() []*GCDHashtab {
+	if s.limits.MaxCached <= 0 {
+		return nil
+	}
+
+	total := 0
+	var candidates []string
+	for key, gcd := range s.gcdHashtabs {
+		if gcd.isDefault() {
+			continue
+		}
+		total++
+		if s.pinned[gcd.Path] == 0 {
+			candidates = append(candidates, key)
+		}
+	}
+	excess := min(total-s.limits.MaxCached, len(candidates))
+	if excess <= 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return s.gcdHashtabs[candidates[i]].lastUsed < s.gcdHashtabs[candidates[j]].lastUsed
+	})
+
+	var evicted []*GCDHashtab
+	for _, key := range candidates[:excess] {
+		gcd := s.gcdHashtabs[key]
+		logging.Info(logging.ComponentGCD, "Evicting GCD hashtab for %s", gcdLabel(gcd.Versions, gcd.requestedDevices))
+		evicted = append(evicted, gcd)
+		delete(s.gcdHashtabs, key)
+		delete(s.sourceModTimes, key)
+	}
+	return evicted
+}
+
+// removeFiles deletes the files of evicted GCDs. A GCD of a single device
+// hashtab uses that hashtab directly, which is never deleted.
+func (s *Service) removeFiles(evicted []*GCDHashtab) {
+	for _, gcd := range evicted {
+		if filepath.Dir(gcd.Path) != filepath.Clean(s.gcdDir) {
+			continue
+		}
+		os.Remove(manifestPath(gcd.Path))
+		if err := os.Remove(gcd.Path); err != nil && !os.IsNotExist(err) {
+			logging.Warn(logging.ComponentGCD, "Failed to remove evicted GCD %s: %v", gcd.Path, err)
+		}
+	}
 }
 
 func (s *Service) GetVersions() []hashtab.VersionInfo {
 	return s.hashtabService.GetVersions()
 }
+
+func (s *Service) GetVersionsMatching(expr string) ([]hashtab.VersionInfo, error) {
+	return s.hashtabService.GetVersionsMatching(expr)
+}
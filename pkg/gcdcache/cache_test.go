@@ -0,0 +1,87 @@
+package gcdcache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func TestEvictionKeepsGCDsInUse(t *testing.T) {
+	hashtabDir := t.TempDir()
+	// Subsets of two devices, as one device's hashtab is used directly.
+	for _, name := range []string{"3.24-rm1", "3.24-rm2", "3.24-rmpp"} {
+		if err := hashtab.Save(filepath.Join(hashtabDir, name), map[uint64]string{1: "a", 2: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := newManifestTestService(t, hashtabDir, t.TempDir())
+	service.limits.MaxCached = 1
+
+	rm1, err := service.GetGCDHashtabForVersions([]string{"3.24"}, []string{"rm1", "rm2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmpp, err := service.GetGCDHashtabForVersions([]string{"3.24"}, []string{"rm2", "rmpp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both are in use, so neither is evicted although only one may be kept.
+	for _, gcd := range []*GCDHashtab{rm1, rmpp} {
+		if _, err := os.Stat(gcd.Path); err != nil {
+			t.Errorf("GCD for %v in use was evicted: %v", gcd.Devices, err)
+		}
+	}
+
+	service.Release(rm1)
+	if _, err := os.Stat(rm1.Path); !os.IsNotExist(err) {
+		t.Errorf("released GCD beyond the limit was not evicted: %v", err)
+	}
+	if _, err := os.Stat(rmpp.Path); err != nil {
+		t.Errorf("GCD in use was evicted: %v", err)
+	}
+
+	// Released, it stays as the one GCD the limit allows.
+	service.Release(rmpp)
+	if _, err := os.Stat(rmpp.Path); err != nil {
+		t.Errorf("GCD within the limit was evicted: %v", err)
+	}
+}
+
+func TestDeviceSubsetGCD(t *testing.T) {
+	h := hashtab.DJB2Hash
+	service := newTestService(t, []table{
+		{name: "3.24-rm1", entries: map[uint64]string{h("width"): "width"}},
+		{name: "3.24-rmpp", entries: map[uint64]string{h("width"): "width", h("statusBar"): "statusBar"}},
+		{name: "3.24-rmppm", entries: map[uint64]string{h("width"): "width", h("statusBar"): "statusBar"}},
+	})
+
+	all, err := service.GetGCDHashtabForVersions([]string{"3.24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Release(all)
+	subset, err := service.GetGCDHashtabForVersions([]string{"3.24"}, []string{"rmppm", "rmpp", "rmpp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Release(subset)
+
+	// Leaving out rm1 keeps the identifiers only the Paper Pros have.
+	if !reflect.DeepEqual(all.Devices, []string{"rm1", "rmpp", "rmppm"}) || all.Entries != 1 {
+		t.Errorf("default GCD = %v with %d entries, want every device and 1 entry", all.Devices, all.Entries)
+	}
+	if !reflect.DeepEqual(subset.Devices, []string{"rmpp", "rmppm"}) || subset.Entries != 2 {
+		t.Errorf("subset GCD = %v with %d entries, want rmpp and rmppm and 2 entries", subset.Devices, subset.Entries)
+	}
+	if subset.Path == all.Path {
+		t.Error("subset GCD shares the default GCD's file")
+	}
+
+	if _, err := service.GetGCDHashtabForVersions([]string{"3.24"}, []string{"rm2"}); err == nil || err.Error() != "device rm2 not available for version 3.24" {
+		t.Errorf("error for a missing device = %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package gcdcache
+
+import (
+	"sort"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// ExcludedEntry is an entry that every device of some versions has, but that
+// fell out of a cross-version GCD because other versions lack it.
+type ExcludedEntry struct {
+	Hash       uint64   `json:"hash,string"`
+	Identifier string   `json:"identifier,omitempty"`
+	Versions   []string `json:"versions"`
+}
+
+// excludedEntries compares each version's own GCD with the cross-version GCD
+// and returns the entries that were lost, along with a per-version count.
+func excludedEntries(versions []string, hashtabs []*hashtab.Hashtab, gcd map[uint64]string) ([]ExcludedEntry, map[string]int) {
+	byVersion := make(map[string][]*hashtab.Hashtab, len(versions))
+	for _, ht := range hashtabs {
+		byVersion[ht.OSVersion] = append(byVersion[ht.OSVersion], ht)
+	}
+
+	excluded := make(map[uint64]*ExcludedEntry)
+	counts := make(map[string]int, len(versions))
+
+	for _, version := range versions {
+		own := Intersect(byVersion[version])
+		for hash, str := range own.Entries {
+			if hash == hashtab.VersionHash {
+				continue
+			}
+			if _, ok := gcd[hash]; ok {
+				continue
+			}
+
+			entry, ok := excluded[hash]
+			if !ok {
+				entry = &ExcludedEntry{Hash: hash}
+				excluded[hash] = entry
+			}
+			if entry.Identifier == "" {
+				entry.Identifier = str
+			}
+			entry.Versions = append(entry.Versions, version)
+			counts[version]++
+		}
+	}
+
+	result := make([]ExcludedEntry, 0, len(excluded))
+	for _, entry := range excluded {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Identifier != result[j].Identifier {
+			return result[i].Identifier < result[j].Identifier
+		}
+		return result[i].Hash < result[j].Hash
+	})
+
+	return result, counts
+}
@@ -0,0 +1,35 @@
+package gcdcache
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func TestExcludedEntries(t *testing.T) {
+	h := hashtab.DJB2Hash
+	hashtabs := loadTables(t, []table{
+		{name: "3.22-rm2", entries: map[uint64]string{h("width"): "width", h("footer"): "footer", h("batteryIndicator"): "batteryIndicator"}},
+		{name: "3.22-rmpp", entries: map[uint64]string{h("width"): "width", h("footer"): "footer", h("statusBar"): "statusBar"}},
+		{name: "3.24-rm2", entries: map[uint64]string{h("width"): "width", h("statusBar"): "statusBar"}},
+		{name: "3.24-rmpp", entries: map[uint64]string{h("width"): "width", h("statusBar"): "statusBar", h("footer"): "footer"}},
+	})
+	versions := []string{"3.22", "3.24"}
+	gcd := Intersect(hashtabs).Entries
+
+	excluded, counts := excludedEntries(versions, hashtabs, gcd)
+
+	// batteryIndicator is on one 3.22 device only, so neither version's own
+	// GCD had it to lose.
+	want := []ExcludedEntry{
+		{Hash: h("footer"), Identifier: "footer", Versions: []string{"3.22"}},
+		{Hash: h("statusBar"), Identifier: "statusBar", Versions: []string{"3.24"}},
+	}
+	if !reflect.DeepEqual(excluded, want) {
+		t.Errorf("excluded = %+v, want %+v", excluded, want)
+	}
+	if want := map[string]int{"3.22": 1, "3.24": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
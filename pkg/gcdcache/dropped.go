@@ -0,0 +1,72 @@
+package gcdcache
+
+import (
+	"fmt"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/qmd"
+)
+
+// DroppedIdentifier is an identifier that the GCD lacks because some of the
+// target device hashtabs do not have it.
+type DroppedIdentifier struct {
+	Identifier string   `json:"identifier"`
+	Hash       uint64   `json:"hash,string"`
+	PresentOn  []string `json:"presentOn"`
+	MissingOn  []string `json:"missingOn"`
+}
+
+// DroppedIdentifiers returns the identifiers that some, but not all, device
+// hashtabs of versions and devices have: those the intersection lost. Words
+// no device has, such as a file's own names and comments, were never in any
+// hashtab and are left out, as are QMD directives. Devices are named by
+// device alone for a single version and as "version/device" otherwise.
+func (s *Service) DroppedIdentifiers(versions, devices, identifiers []string) ([]DroppedIdentifier, error) {
+	versions = normalizeVersions(versions)
+	devices = normalizeDevices(devices)
+
+	hashtabs, err := s.selectHashtabs(versions, devices)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, len(hashtabs))
+	for i, ht := range hashtabs {
+		if len(versions) == 1 {
+			labels[i] = ht.Device
+		} else {
+			labels[i] = fmt.Sprintf("%s/%s", ht.OSVersion, ht.Device)
+		}
+	}
+
+	var dropped []DroppedIdentifier
+	for _, id := range identifiers {
+		if qmd.IsKeyword(id) {
+			continue
+		}
+		hash := hashtab.DJB2Hash(id)
+		if hash == hashtab.VersionHash {
+			continue
+		}
+
+		var present, missing []string
+		for i, ht := range hashtabs {
+			if ht.Has(hash) {
+				present = append(present, labels[i])
+			} else {
+				missing = append(missing, labels[i])
+			}
+		}
+
+		if len(present) > 0 && len(missing) > 0 {
+			dropped = append(dropped, DroppedIdentifier{
+				Identifier: id,
+				Hash:       hash,
+				PresentOn:  present,
+				MissingOn:  missing,
+			})
+		}
+	}
+
+	return dropped, nil
+}
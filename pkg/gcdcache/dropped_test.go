@@ -0,0 +1,91 @@
+package gcdcache
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func newTestService(t *testing.T, tables []table) *Service {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, tb := range tables {
+		if err := hashtab.Save(filepath.Join(dir, tb.name), tb.entries); err != nil {
+			t.Fatalf("failed to write %s: %v", tb.name, err)
+		}
+	}
+
+	hashtabs, err := hashtab.NewService(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashtabs.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewService(t.TempDir(), hashtabs, 1, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestDroppedIdentifiers(t *testing.T) {
+	h := hashtab.DJB2Hash
+	service := newTestService(t, []table{
+		{name: "3.22-rm2", entries: map[uint64]string{h("width"): "width", h("batteryIndicator"): "batteryIndicator", h("footer"): "footer"}},
+		{name: "3.22-rmpp", entries: map[uint64]string{h("width"): "width", h("batteryIndicator"): "batteryIndicator"}},
+		{name: "3.24-rm2", entries: map[uint64]string{h("width"): "width", h("footer"): "footer"}},
+		{name: "3.24-rmpp", entries: map[uint64]string{h("width"): "width", h("statusBar"): "statusBar"}},
+	})
+
+	// The file's own id, a comment word and a directive are in no hashtab.
+	identifiers := []string{"AFFECT", "width", "batteryIndicator", "footer", "statusBar", "myPanel", "TODO"}
+
+	tests := []struct {
+		name     string
+		versions []string
+		devices  []string
+		want     []DroppedIdentifier
+	}{
+		{
+			name:     "one version",
+			versions: []string{"3.22"},
+			want: []DroppedIdentifier{
+				{Identifier: "footer", Hash: h("footer"), PresentOn: []string{"rm2"}, MissingOn: []string{"rmpp"}},
+			},
+		},
+		{
+			name:     "across versions",
+			versions: []string{"3.22", "3.24"},
+			want: []DroppedIdentifier{
+				{Identifier: "batteryIndicator", Hash: h("batteryIndicator"), PresentOn: []string{"3.22/rm2", "3.22/rmpp"}, MissingOn: []string{"3.24/rm2", "3.24/rmpp"}},
+				{Identifier: "footer", Hash: h("footer"), PresentOn: []string{"3.22/rm2", "3.24/rm2"}, MissingOn: []string{"3.22/rmpp", "3.24/rmpp"}},
+				{Identifier: "statusBar", Hash: h("statusBar"), PresentOn: []string{"3.24/rmpp"}, MissingOn: []string{"3.22/rm2", "3.22/rmpp", "3.24/rm2"}},
+			},
+		},
+		{
+			name:     "one device",
+			versions: []string{"3.22", "3.24"},
+			devices:  []string{"rm2"},
+			want: []DroppedIdentifier{
+				{Identifier: "batteryIndicator", Hash: h("batteryIndicator"), PresentOn: []string{"3.22/rm2"}, MissingOn: []string{"3.24/rm2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.DroppedIdentifiers(tt.versions, tt.devices, identifiers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DroppedIdentifiers = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
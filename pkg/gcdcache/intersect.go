@@ -0,0 +1,79 @@
+package gcdcache
+
+import (
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// Intersection is the common subset of a set of device hashtabs.
+type Intersection struct {
+	Entries  map[uint64]string
+	HashOnly bool
+	// Dropped counts, per device, the entries that are not present in every
+	// other hashtab and were therefore left out of the intersection.
+	Dropped map[string]int
+}
+
+// Intersect keeps only the hashes present in every given hashtab. Strings are
+// taken from the first hashtab that has one for a hash, so intersecting a
+// hashlist with a full hashtab still yields readable entries. The result is a
+// hashlist only when every input is a hashlist. The version entry is kept
+// only when every input carries the same version string.
+func Intersect(hashtabs []*hashtab.Hashtab) *Intersection {
+	result := &Intersection{
+		Entries:  make(map[uint64]string),
+		HashOnly: true,
+		Dropped:  make(map[string]int, len(hashtabs)),
+	}
+
+	if len(hashtabs) == 0 {
+		return result
+	}
+
+	smallest := hashtabs[0]
+	for _, ht := range hashtabs[1:] {
+		if ht.Len() < smallest.Len() {
+			smallest = ht
+		}
+	}
+
+	smallest.Range(func(hash uint64, _ string) bool {
+		value := ""
+		for _, ht := range hashtabs {
+			str, ok := ht.Lookup(hash)
+			if !ok {
+				return true
+			}
+			if value == "" {
+				value = str
+			}
+		}
+		result.Entries[hash] = value
+		return true
+	})
+
+	if version, ok := result.Entries[hashtab.VersionHash]; ok {
+		for _, ht := range hashtabs {
+			if str, _ := ht.Lookup(hashtab.VersionHash); str != version {
+				delete(result.Entries, hashtab.VersionHash)
+				break
+			}
+		}
+	}
+
+	for _, ht := range hashtabs {
+		if !ht.IsHashlist() {
+			result.HashOnly = false
+		}
+		result.Dropped[ht.Device] += ht.Len() - len(result.Entries)
+	}
+
+	return result
+}
+
+// Save writes the intersection to path in the same format as its inputs.
+func (in *Intersection) Save(path string) error {
+	if in.HashOnly {
+		return hashtab.SaveHashlist(path, in.Entries)
+	}
+	return hashtab.Save(path, in.Entries)
+}
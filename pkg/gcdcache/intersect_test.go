@@ -0,0 +1,174 @@
+package gcdcache
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// table describes a device hashtab to write for a test.
+type table struct {
+	name     string
+	hashlist bool
+	entries  map[uint64]string
+}
+
+func loadTables(t *testing.T, tables []table) []*hashtab.Hashtab {
+	t.Helper()
+
+	dir := t.TempDir()
+	loaded := make([]*hashtab.Hashtab, 0, len(tables))
+	for _, tb := range tables {
+		path := filepath.Join(dir, tb.name)
+		save := hashtab.Save
+		if tb.hashlist {
+			save = hashtab.SaveHashlist
+		}
+		if err := save(path, tb.entries); err != nil {
+			t.Fatalf("failed to write %s: %v", tb.name, err)
+		}
+		ht, err := hashtab.Load(path)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", tb.name, err)
+		}
+		loaded = append(loaded, ht)
+	}
+	return loaded
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name     string
+		tables   []table
+		entries  map[uint64]string
+		hashOnly bool
+		dropped  map[string]int
+	}{
+		{
+			name: "hashtabs",
+			tables: []table{
+				{name: "3.24-rm1", entries: map[uint64]string{hashtab.VersionHash: "3.24", 1: "a", 2: "b", 3: "c"}},
+				{name: "3.24-rm2", entries: map[uint64]string{hashtab.VersionHash: "3.24", 2: "b", 3: "c", 4: "d"}},
+			},
+			entries: map[uint64]string{hashtab.VersionHash: "3.24", 2: "b", 3: "c"},
+			dropped: map[string]int{"rm1": 1, "rm2": 1},
+		},
+		{
+			name: "hashlist with hashtab takes strings from the hashtab",
+			tables: []table{
+				{name: "3.24-rmpp", hashlist: true, entries: map[uint64]string{1: "", 2: "", 5: ""}},
+				{name: "3.24-rm2", entries: map[uint64]string{1: "a", 2: "b", 3: "c"}},
+			},
+			entries: map[uint64]string{1: "a", 2: "b"},
+			dropped: map[string]int{"rmpp": 1, "rm2": 1},
+		},
+		{
+			name: "hashlists",
+			tables: []table{
+				{name: "3.24-rm1", hashlist: true, entries: map[uint64]string{1: "", 2: ""}},
+				{name: "3.24-rm2", hashlist: true, entries: map[uint64]string{2: "", 3: ""}},
+			},
+			entries:  map[uint64]string{2: ""},
+			hashOnly: true,
+			dropped:  map[string]int{"rm1": 1, "rm2": 1},
+		},
+		{
+			name: "mismatched version entries are dropped",
+			tables: []table{
+				{name: "3.24-rm1", entries: map[uint64]string{hashtab.VersionHash: "3.24.0.147", 1: "a", 2: "b"}},
+				{name: "3.24-rm2", entries: map[uint64]string{hashtab.VersionHash: "3.24.0.149", 1: "a", 2: "b"}},
+			},
+			entries: map[uint64]string{1: "a", 2: "b"},
+			dropped: map[string]int{"rm1": 1, "rm2": 1},
+		},
+		{
+			name: "version entry missing from one input",
+			tables: []table{
+				{name: "3.24-rm1", entries: map[uint64]string{hashtab.VersionHash: "3.24", 1: "a"}},
+				{name: "3.24-rm2", entries: map[uint64]string{1: "a"}},
+			},
+			entries: map[uint64]string{1: "a"},
+			dropped: map[string]int{"rm1": 1, "rm2": 0},
+		},
+		{
+			name: "single hashtab",
+			tables: []table{
+				{name: "3.24-rm1", entries: map[uint64]string{1: "a", 2: "b"}},
+			},
+			entries: map[uint64]string{1: "a", 2: "b"},
+			dropped: map[string]int{"rm1": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Intersect(loadTables(t, tt.tables))
+
+			if !reflect.DeepEqual(got.Entries, tt.entries) {
+				t.Errorf("entries = %v, want %v", got.Entries, tt.entries)
+			}
+			if got.HashOnly != tt.hashOnly {
+				t.Errorf("HashOnly = %v, want %v", got.HashOnly, tt.hashOnly)
+			}
+			if !reflect.DeepEqual(got.Dropped, tt.dropped) {
+				t.Errorf("Dropped = %v, want %v", got.Dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestIntersectNone(t *testing.T) {
+	got := Intersect(nil)
+	if len(got.Entries) != 0 {
+		t.Errorf("entries = %v, want none", got.Entries)
+	}
+}
+
+func TestIntersectionSaveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables []table
+	}{
+		{
+			name: "hashtab",
+			tables: []table{
+				{name: "3.24-rm1", entries: map[uint64]string{hashtab.VersionHash: "3.24", 1: "a", 2: "b", 3: "c"}},
+				{name: "3.24-rm2", entries: map[uint64]string{hashtab.VersionHash: "3.24", 1: "a", 3: "c"}},
+			},
+		},
+		{
+			name: "hashlist",
+			tables: []table{
+				{name: "3.24-rm1", hashlist: true, entries: map[uint64]string{hashtab.VersionHash: "3.24", 1: "", 2: ""}},
+				{name: "3.24-rm2", hashlist: true, entries: map[uint64]string{hashtab.VersionHash: "3.24", 2: ""}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := Intersect(loadTables(t, tt.tables))
+
+			path := filepath.Join(t.TempDir(), "3.24.gcd")
+			if err := in.Save(path); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+
+			ht, err := hashtab.Load(path)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := ht.Entries(); !reflect.DeepEqual(got, in.Entries) {
+				t.Errorf("loaded entries = %v, want %v", got, in.Entries)
+			}
+			if ht.IsHashlist() != in.HashOnly {
+				t.Errorf("IsHashlist = %v, want %v", ht.IsHashlist(), in.HashOnly)
+			}
+			if ht.OSVersion != "3.24" {
+				t.Errorf("OSVersion = %q, want %q", ht.OSVersion, "3.24")
+			}
+		})
+	}
+}
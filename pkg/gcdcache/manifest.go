@@ -0,0 +1,159 @@
+package gcdcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+// generatorVersion identifies the GCD engine that wrote a file. Bump it when
+// the intersection or output format changes so existing GCDs are regenerated.
+const generatorVersion = "native-1"
+
+type SourceInfo struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest is the sidecar written next to each generated GCD hashtab. It
+// records the inputs the GCD was built from so it can be reused across restarts.
+// GCD files are named by a digest, so Version, Versions and Devices say which
+// GCD a file holds; Devices is empty when the GCD covers every device. Size
+// and SHA256 describe the GCD file itself, so a damaged one is not reused.
+type Manifest struct {
+	Version        string          `json:"version"`
+	Versions       []string        `json:"versions"`
+	Devices        []string        `json:"devices,omitempty"`
+	Generator      string          `json:"generator"`
+	GeneratedAt    time.Time       `json:"generatedAt"`
+	Entries        int             `json:"entries"`
+	Dropped        map[string]int  `json:"dropped,omitempty"`
+	Excluded       []ExcludedEntry `json:"excluded,omitempty"`
+	ExcludedCounts map[string]int  `json:"excludedCounts,omitempty"`
+	Sources        []SourceInfo    `json:"sources"`
+	Size           int64           `json:"size"`
+	SHA256         string          `json:"sha256"`
+}
+
+func manifestPath(gcdPath string) string {
+	return gcdPath + ".json"
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse GCD manifest %s: %w", path, err)
+	}
+
+	return &m, nil
+}
+
+func (m *Manifest) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode GCD manifest: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create GCD manifest: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write GCD manifest: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename GCD manifest: %w", err)
+	}
+
+	return nil
+}
+
+// describes reports whether the GCD file at path is the one the manifest was
+// written for.
+func (m *Manifest) describes(path string) bool {
+	info, err := describeFile(path)
+	if err != nil {
+		return false
+	}
+	return m.SHA256 != "" && info.Size == m.Size && info.SHA256 == m.SHA256
+}
+
+// matches reports whether the manifest was produced by this generator from
+// exactly the given sources.
+func (m *Manifest) matches(sources []SourceInfo) bool {
+	if m.Generator != generatorVersion || len(m.Sources) != len(sources) {
+		return false
+	}
+	for i := range sources {
+		if m.Sources[i] != sources[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeSources describes hashtabs as they were loaded, which is what a
+// GCD built from them contains, even if their files have changed since.
+func describeSources(hashtabs []*hashtab.Hashtab) []SourceInfo {
+	sources := make([]SourceInfo, 0, len(hashtabs))
+	for _, ht := range hashtabs {
+		sources = append(sources, SourceInfo{
+			Path:   ht.Path,
+			Size:   ht.Size(),
+			SHA256: ht.SHA256(),
+		})
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Path < sources[j].Path
+	})
+
+	return sources
+}
+
+// describeFile describes the file at path as it is on disk.
+func describeFile(path string) (SourceInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SourceInfo{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return SourceInfo{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return SourceInfo{
+		Path:   path,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
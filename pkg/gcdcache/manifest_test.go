@@ -0,0 +1,180 @@
+package gcdcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/pkg/hashtab"
+)
+
+func TestCorruptGCDIsRegenerated(t *testing.T) {
+	hashtabDir := t.TempDir()
+	gcdDir := t.TempDir()
+	for _, name := range []string{"3.24-rm2", "3.24-rmpp"} {
+		if err := hashtab.Save(filepath.Join(hashtabDir, name), map[uint64]string{1: "a", 2: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func() *GCDHashtab {
+		t.Helper()
+		hashtabs, err := hashtab.NewService(hashtabDir, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hashtabs.LoadAll(); err != nil {
+			t.Fatal(err)
+		}
+		service, err := NewService(gcdDir, hashtabs, 1, Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gcd, err := service.GetGCDHashtabForVersions([]string{"3.24"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gcd
+	}
+
+	gcd := build()
+	manifest, err := loadManifest(manifestPath(gcd.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.describes(gcd.Path) {
+		t.Fatal("manifest does not describe the GCD it was written for")
+	}
+
+	original, err := os.ReadFile(gcd.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gcd.Path, original[:len(original)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gcd = build()
+	if rebuilt, err := os.ReadFile(gcd.Path); err != nil || string(rebuilt) != string(original) {
+		t.Errorf("truncated GCD was reused instead of regenerated")
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(gcdDir, ".*"))
+	if len(leftovers) != 0 {
+		t.Errorf("temporary files left in the GCD directory: %v", leftovers)
+	}
+}
+
+// newManifestTestService loads the hashtabs in hashtabDir and returns a GCD
+// service writing to gcdDir, as the server does at startup.
+func newManifestTestService(t *testing.T, hashtabDir, gcdDir string) *Service {
+	t.Helper()
+	hashtabs, err := hashtab.NewService(hashtabDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashtabs.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewService(gcdDir, hashtabs, 1, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func writeSources(t *testing.T, dir string, entries map[uint64]string) {
+	t.Helper()
+	for _, name := range []string{"3.24-rm2", "3.24-rmpp"} {
+		if err := hashtab.Save(filepath.Join(dir, name), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGCDReusedAcrossRestart(t *testing.T) {
+	hashtabDir := t.TempDir()
+	gcdDir := t.TempDir()
+	writeSources(t, hashtabDir, map[uint64]string{1: "a", 2: "b"})
+
+	generate := func() *Manifest {
+		t.Helper()
+		service := newManifestTestService(t, hashtabDir, gcdDir)
+		if err := service.GenerateAll(); err != nil {
+			t.Fatal(err)
+		}
+		gcd, err := service.GetGCDHashtabForVersions([]string{"3.24"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := loadManifest(manifestPath(gcd.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+
+	first := generate()
+
+	// A GCD of a previous run that nothing uses any more is swept.
+	stale := filepath.Join(gcdDir, "stale.gcd")
+	if err := os.WriteFile(stale, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	second := generate()
+	if !second.GeneratedAt.Equal(first.GeneratedAt) {
+		t.Errorf("GCD was regenerated at %s instead of reused from %s", second.GeneratedAt, first.GeneratedAt)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("unused GCD was not swept: %v", err)
+	}
+}
+
+func TestManifestDescribesLoadedSources(t *testing.T) {
+	hashtabDir := t.TempDir()
+	writeSources(t, hashtabDir, map[uint64]string{1: "a", 2: "b"})
+	service := newManifestTestService(t, hashtabDir, t.TempDir())
+
+	// The files change after loading, before the GCD is built from what was
+	// loaded.
+	writeSources(t, hashtabDir, map[uint64]string{1: "a"})
+
+	if err := service.generateGCD([]string{"3.24"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	gcd := service.gcdHashtabs[gcdKey([]string{"3.24"}, nil)]
+	manifest, err := loadManifest(manifestPath(gcd.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ht := range service.hashtabService.GetHashtabsForVersion("3.24") {
+		if src := manifest.Sources[i]; src.SHA256 != ht.SHA256() || src.Size != ht.Size() {
+			t.Errorf("source %s = %+v, want the loaded digest %s", ht.Path, src, ht.SHA256())
+		}
+	}
+}
+
+func TestSweepKeepsGCDsBeingBuilt(t *testing.T) {
+	gcdDir := t.TempDir()
+	service := newManifestTestService(t, t.TempDir(), gcdDir)
+
+	building := filepath.Join(gcdDir, "building.gcd")
+	unused := filepath.Join(gcdDir, "unused.gcd")
+	for _, path := range []string{building, unused} {
+		if err := os.WriteFile(path, []byte("gcd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.building[building] = 1
+
+	service.sweep()
+
+	if _, err := os.Stat(building); err != nil {
+		t.Errorf("GCD being built was swept: %v", err)
+	}
+	if _, err := os.Stat(unused); !os.IsNotExist(err) {
+		t.Errorf("unused GCD was not swept: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package hashtab
+
+import "strconv"
+
+// DeviceCompatibility reports which of a set of hashes one device hashtab lacks.
+type DeviceCompatibility struct {
+	Device     string   `json:"device"`
+	Compatible bool     `json:"compatible"`
+	Missing    []string `json:"missing"`
+}
+
+// VersionCompatibility is one row of a compatibility matrix.
+type VersionCompatibility struct {
+	Version    string                `json:"version"`
+	Compatible bool                  `json:"compatible"`
+	Devices    []DeviceCompatibility `json:"devices"`
+}
+
+// CheckCompatibility looks every hash up in every loaded hashtab and returns a
+// matrix of versions (newest first) by devices. Missing hashes are listed in
+// decimal, in the order given.
+func (s *Service) CheckCompatibility(hashes []uint64) []VersionCompatibility {
+	versions := s.GetVersions()
+	matrix := make([]VersionCompatibility, 0, len(versions))
+
+	for _, v := range versions {
+		row := VersionCompatibility{
+			Version:    v.Version,
+			Compatible: true,
+			Devices:    make([]DeviceCompatibility, 0, len(v.Devices)),
+		}
+
+		for _, device := range v.Devices {
+			cell := DeviceCompatibility{
+				Device:  device,
+				Missing: []string{},
+			}
+			if ht := s.getHashtab(v.Version, device); ht != nil {
+				for _, hash := range hashes {
+					if !ht.Has(hash) {
+						cell.Missing = append(cell.Missing, strconv.FormatUint(hash, 10))
+					}
+				}
+			}
+			cell.Compatible = len(cell.Missing) == 0
+			if !cell.Compatible {
+				row.Compatible = false
+			}
+			row.Devices = append(row.Devices, cell)
+		}
+
+		matrix = append(matrix, row)
+	}
+
+	return matrix
+}
+
+func (s *Service) getHashtab(version, device string) *Hashtab {
+	for _, ht := range s.GetHashtabsForVersion(version) {
+		if ht.Device == device {
+			return ht
+		}
+	}
+	return nil
+}
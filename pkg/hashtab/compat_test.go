@@ -0,0 +1,52 @@
+package hashtab
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	dir := t.TempDir()
+	for name, entries := range map[string]map[uint64]string{
+		"3.22-rm2":  {1: "width", 2: "height"},
+		"3.24-rm2":  {1: "width", 2: "height", 3: "statusBar"},
+		"3.24-rmpp": {1: "width", 3: "statusBar"},
+	} {
+		save := Save
+		if name == "3.24-rmpp" {
+			save = SaveHashlist
+		}
+		if err := save(filepath.Join(dir, name), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewService(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hashlist has no strings but still answers which hashes it has.
+	got := s.CheckCompatibility([]uint64{3, 1, 2})
+	want := []VersionCompatibility{
+		{Version: "3.24", Compatible: false, Devices: []DeviceCompatibility{
+			{Device: "rm2", Compatible: true, Missing: []string{}},
+			{Device: "rmpp", Compatible: false, Missing: []string{"2"}},
+		}},
+		{Version: "3.22", Compatible: false, Devices: []DeviceCompatibility{
+			{Device: "rm2", Compatible: false, Missing: []string{"3"}},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckCompatibility =\n%+v\nwant\n%+v", got, want)
+	}
+
+	for _, row := range s.CheckCompatibility([]uint64{1}) {
+		if !row.Compatible {
+			t.Errorf("version %s incompatible with a hash every device has", row.Version)
+		}
+	}
+}
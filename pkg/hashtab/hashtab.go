@@ -1,22 +1,66 @@
 package hashtab
 
 import (
+	"cmp"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
+	"math"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 )
 
 const maxStringLength = 10 * 1024 * 1024 // 10MB
 
+// useMmap controls whether Load memory-maps hashtab files. It is off by
+// default: hashtabs are read onto the heap.
+var useMmap = false
+
+// SetMmap enables or disables memory-mapping of hashtab files loaded after
+// the call. Mapped files must be replaced atomically (write a new file, then
+// rename it over the old one); truncating a mapped file in place, as cp and
+// rsync --inplace do, crashes the process on the next read.
+func SetMmap(enabled bool) {
+	useMmap = enabled
+}
+
+// VersionHash is the reserved hash whose entry holds the OS version string.
+const VersionHash uint64 = 17607111715072197239
+
+// Hashtab is a read-only device hashtab. Its entries are kept in a compact
+// form, a sorted index of hashes pointing into the file's bytes (memory-mapped
+// where supported), rather than as a map; use Lookup, Has and Range, or
+// Entries to build a map when one is really needed.
 type Hashtab struct {
 	Name      string
 	Path      string
 	OSVersion string
 	Device    string
-	Entries   map[uint64]string
+	// Hardware, Channel and Manifest are only set when the hashtab is
+	// described by a manifest; Manifest is that manifest's path.
+	Hardware string
+	Channel  string
+	Manifest string
+
+	index    []indexEntry
+	data     []byte
+	hashOnly bool
+
+	digestOnce sync.Once
+	digest     string
+}
+
+// indexEntry locates the string of one hash in a hashtab's data.
+type indexEntry struct {
+	hash   uint64
+	offset uint32
+	length uint32
 }
 
 func ParseVersion(filename string) (osVersion, device string) {
@@ -36,85 +80,184 @@ func ParseVersion(filename string) (osVersion, device string) {
 	return
 }
 
+// IsHashlist reports whether the hashtab only records hashes, without strings.
 func (ht *Hashtab) IsHashlist() bool {
-	for _, val := range ht.Entries {
-		if val != "" {
-			return false
+	return ht.hashOnly
+}
+
+// Len returns the number of entries, including the version entry.
+func (ht *Hashtab) Len() int {
+	return len(ht.index)
+}
+
+func (ht *Hashtab) find(hash uint64) (indexEntry, bool) {
+	i := sort.Search(len(ht.index), func(i int) bool {
+		return ht.index[i].hash >= hash
+	})
+	if i < len(ht.index) && ht.index[i].hash == hash {
+		return ht.index[i], true
+	}
+	return indexEntry{}, false
+}
+
+// The data of a mapped hashtab is unmapped by a finalizer on the Hashtab, so
+// every method that reads ht.data keeps ht alive until it has finished.
+
+// Has reports whether the hashtab contains hash.
+func (ht *Hashtab) Has(hash uint64) bool {
+	_, ok := ht.find(hash)
+	return ok
+}
+
+// Lookup returns the string stored for hash, which is empty in a hashlist.
+func (ht *Hashtab) Lookup(hash uint64) (string, bool) {
+	e, ok := ht.find(hash)
+	if !ok {
+		return "", false
+	}
+	return ht.str(e), true
+}
+
+func (ht *Hashtab) str(e indexEntry) string {
+	s := string(ht.data[e.offset : e.offset+e.length])
+	runtime.KeepAlive(ht)
+	return s
+}
+
+// Range calls fn for every entry in ascending hash order until fn returns false.
+func (ht *Hashtab) Range(fn func(hash uint64, str string) bool) {
+	for _, e := range ht.index {
+		if !fn(e.hash, ht.str(e)) {
+			return
 		}
 	}
-	return true
+}
+
+// SHA256 returns the hex SHA-256 digest of the hashtab file as loaded. It is
+// computed on first use.
+func (ht *Hashtab) SHA256() string {
+	ht.digestOnce.Do(func() {
+		sum := sha256.Sum256(ht.data)
+		runtime.KeepAlive(ht)
+		ht.digest = hex.EncodeToString(sum[:])
+	})
+	return ht.digest
+}
+
+// Size returns the size in bytes of the hashtab file as loaded.
+func (ht *Hashtab) Size() int64 {
+	return int64(len(ht.data))
+}
+
+// Entries builds a map of every entry. It allocates the whole hashtab, so
+// prefer Lookup and Range.
+func (ht *Hashtab) Entries() map[uint64]string {
+	entries := make(map[uint64]string, len(ht.index))
+	ht.Range(func(hash uint64, str string) bool {
+		entries[hash] = str
+		return true
+	})
+	return entries
 }
 
 func Load(path string) (*Hashtab, error) {
-	file, err := os.Open(path)
+	data, unmap, err := mapFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open hashtab file: %w", err)
 	}
-	defer file.Close()
-
-	entries, hashtabVersion, err := loadHashtab(file)
-	if err != nil {
-		return nil, err
-	}
 
 	filename := filepath.Base(path)
 	osVersion, device := ParseVersion(filename)
 
-	if hashtabVersion != "" {
-		osVersion = hashtabVersion
-	}
-
-	return &Hashtab{
+	ht := &Hashtab{
 		Name:      filename,
 		Path:      path,
 		OSVersion: osVersion,
 		Device:    device,
-		Entries:   entries,
-	}, nil
+		data:      data,
+	}
+
+	hashtabVersion, err := ht.buildIndex()
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return nil, err
+	}
+
+	if hashtabVersion != "" {
+		ht.OSVersion = hashtabVersion
+	}
+
+	if unmap != nil {
+		runtime.SetFinalizer(ht, func(*Hashtab) { unmap() })
+	}
+
+	return ht, nil
 }
 
-func loadHashtab(file *os.File) (map[uint64]string, string, error) {
-	entries := make(map[uint64]string)
+// buildIndex indexes every entry of ht.data by hash and returns the version
+// string, if any. Hash 0 is skipped; for repeated hashes the last entry wins.
+func (ht *Hashtab) buildIndex() (string, error) {
+	data := ht.data
+	if uint64(len(data)) > math.MaxUint32 {
+		return "", fmt.Errorf("hashtab file is too large (%d bytes)", len(data))
+	}
+
+	var index []indexEntry
 	var hashtabVersion string
+	hashOnly := true
 
-	for {
-		var hash uint64
-		err := binary.Read(file, binary.BigEndian, &hash)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to read hash: %w", err)
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return "", fmt.Errorf("failed to read hash: %w", io.ErrUnexpectedEOF)
 		}
+		hash := binary.BigEndian.Uint64(data[pos:])
+		pos += 8
 
-		var length uint32
-		err = binary.Read(file, binary.BigEndian, &length)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to read length: %w", err)
+		if len(data)-pos < 4 {
+			return "", fmt.Errorf("failed to read length: %w", io.ErrUnexpectedEOF)
 		}
+		length := binary.BigEndian.Uint32(data[pos:])
+		pos += 4
 
 		if length > maxStringLength {
-			return nil, "", fmt.Errorf("string length %d exceeds maximum %d, file is likely not a valid hashtab", length, maxStringLength)
+			return "", fmt.Errorf("string length %d exceeds maximum %d, file is likely not a valid hashtab", length, maxStringLength)
 		}
-
-		data := make([]byte, length)
-		_, err = io.ReadFull(file, data)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to read string data: %w", err)
+		if uint64(len(data)-pos) < uint64(length) {
+			return "", fmt.Errorf("failed to read string data: %w", io.ErrUnexpectedEOF)
 		}
 
-		str := string(data)
+		e := indexEntry{hash: hash, offset: uint32(pos), length: length}
+		pos += int(length)
 
 		if hash == 0 {
 			continue
-		} else if hash == 17607111715072197239 {
-			hashtabVersion = str
+		} else if hash == VersionHash {
+			hashtabVersion = ht.str(e)
+		} else if length > 0 {
+			hashOnly = false
 		}
 
-		entries[hash] = str
+		index = append(index, e)
 	}
 
-	return entries, hashtabVersion, nil
+	slices.SortStableFunc(index, func(a, b indexEntry) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	deduped := index[:0]
+	for i, e := range index {
+		if i+1 < len(index) && index[i+1].hash == e.hash {
+			continue
+		}
+		deduped = append(deduped, e)
+	}
+
+	ht.index = slices.Clip(deduped)
+	ht.hashOnly = hashOnly
+
+	return hashtabVersion, nil
 }
 
 func DJB2Hash(s string) uint64 {
@@ -0,0 +1,133 @@
+package hashtab
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func loadRaw(t *testing.T, name string, entries ...rawEntry) *Hashtab {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, encode(entries...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ht, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return ht
+}
+
+func TestLoadIndex(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		name := "heap"
+		if mmap {
+			name = "mmap"
+		}
+		t.Run(name, func(t *testing.T) {
+			defer SetMmap(useMmap)
+			SetMmap(mmap)
+
+			ht := loadRaw(t, "3.22-rm1",
+				rawEntry{30, "thirty"},
+				rawEntry{VersionHash, "3.24.0.149"},
+				rawEntry{10, "ten"},
+				rawEntry{0, "ignored"},
+				rawEntry{20, "first"},
+				rawEntry{20, "second"},
+			)
+
+			if ht.Len() != 4 {
+				t.Errorf("Len = %d, want 4", ht.Len())
+			}
+			if ht.OSVersion != "3.24.0.149" {
+				t.Errorf("OSVersion = %q, want the embedded version", ht.OSVersion)
+			}
+			if ht.Device != "rm1" {
+				t.Errorf("Device = %q, want %q", ht.Device, "rm1")
+			}
+			if ht.IsHashlist() {
+				t.Error("IsHashlist = true for a hashtab with strings")
+			}
+
+			lookups := []struct {
+				hash uint64
+				want string
+				ok   bool
+			}{
+				{10, "ten", true},
+				{20, "second", true},
+				{30, "thirty", true},
+				{VersionHash, "3.24.0.149", true},
+				{0, "", false},
+				{15, "", false},
+				{31, "", false},
+			}
+			for _, l := range lookups {
+				got, ok := ht.Lookup(l.hash)
+				if got != l.want || ok != l.ok {
+					t.Errorf("Lookup(%d) = %q, %v, want %q, %v", l.hash, got, ok, l.want, l.ok)
+				}
+				if ht.Has(l.hash) != l.ok {
+					t.Errorf("Has(%d) = %v, want %v", l.hash, !l.ok, l.ok)
+				}
+			}
+
+			var hashes []uint64
+			ht.Range(func(hash uint64, _ string) bool {
+				hashes = append(hashes, hash)
+				return true
+			})
+			if want := []uint64{10, 20, 30, VersionHash}; !reflect.DeepEqual(hashes, want) {
+				t.Errorf("Range order = %v, want %v", hashes, want)
+			}
+
+			var first []uint64
+			ht.Range(func(hash uint64, _ string) bool {
+				first = append(first, hash)
+				return len(first) < 2
+			})
+			if len(first) != 2 {
+				t.Errorf("Range visited %d entries after fn returned false, want 2", len(first))
+			}
+		})
+	}
+}
+
+func TestLoadHashlist(t *testing.T) {
+	ht := loadRaw(t, "3.24-rmpp",
+		rawEntry{VersionHash, "3.24"},
+		rawEntry{2, ""},
+		rawEntry{1, ""},
+	)
+
+	if !ht.IsHashlist() {
+		t.Error("IsHashlist = false for a hash-only file")
+	}
+	if str, ok := ht.Lookup(2); !ok || str != "" {
+		t.Errorf("Lookup(2) = %q, %v, want \"\", true", str, ok)
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	ht := loadRaw(t, "3.24-rm2")
+	if ht.Len() != 0 || ht.Has(1) {
+		t.Errorf("empty hashtab has entries")
+	}
+}
+
+func TestLoadRejectsTruncated(t *testing.T) {
+	data := encode(rawEntry{1, "abc"})
+	for _, n := range []int{4, 10, len(data) - 1} {
+		path := filepath.Join(t.TempDir(), "3.24-rm2")
+		if err := os.WriteFile(path, data[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load accepted a file truncated to %d bytes", n)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package hashtab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestExts are the extensions of sidecar manifests, tried in order: the
+// manifest of "3.24.0.149-rm2" is "3.24.0.149-rm2.json", ".yaml" or ".yml".
+var manifestExts = []string{".json", ".yaml", ".yml"}
+
+// dirManifestNames are the names of a directory manifest, which describes
+// several hashtabs of its directory at once.
+var dirManifestNames = []string{"hashtabs.json", "hashtabs.yaml", "hashtabs.yml"}
+
+// Metadata describes a hashtab file. It is read from a sidecar or directory
+// manifest and takes precedence over what the filename suggests.
+type Metadata struct {
+	Version string `json:"version" yaml:"version"`
+	Device  string `json:"device" yaml:"device"`
+	// Hardware is the device's hardware codename, e.g. "zero-sugar".
+	Hardware string `json:"hardware,omitempty" yaml:"hardware,omitempty"`
+	// Channel is the release channel the version was taken from, e.g. "stable" or "beta".
+	Channel string `json:"channel,omitempty" yaml:"channel,omitempty"`
+	// SHA256 is the hex checksum of the hashtab file; it is verified on load.
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+}
+
+// DirManifest lists the metadata of hashtabs in its directory by filename.
+type DirManifest struct {
+	Hashtabs map[string]Metadata `json:"hashtabs" yaml:"hashtabs"`
+}
+
+// isManifest reports whether name is a sidecar or directory manifest rather
+// than a hashtab.
+func isManifest(name string) bool {
+	for _, ext := range manifestExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestPaths returns the sidecar and directory manifests that could
+// describe the hashtab at path, whether or not they exist.
+func manifestPaths(path string) []string {
+	paths := make([]string, 0, len(manifestExts)+len(dirManifestNames))
+	for _, ext := range manifestExts {
+		paths = append(paths, path+ext)
+	}
+	for _, name := range dirManifestNames {
+		paths = append(paths, filepath.Join(filepath.Dir(path), name))
+	}
+	return paths
+}
+
+// manifestModTime returns the latest modification time of the manifests
+// describing the hashtab at path, so a change to one reloads the hashtab.
+func manifestModTime(path string) time.Time {
+	var latest time.Time
+	for _, p := range manifestPaths(path) {
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// LoadMetadata returns the metadata declared for the hashtab at path by its
+// sidecar manifest or by a manifest of its directory, along with the path of
+// that manifest. It returns nil metadata when no manifest describes the file,
+// and an error when a manifest cannot be read, is invalid, or when the file is
+// described more than once.
+func LoadMetadata(path string) (*Metadata, string, error) {
+	var found *Metadata
+	var foundIn string
+
+	for _, ext := range manifestExts {
+		sidecar := path + ext
+		data, err := os.ReadFile(sidecar)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, "", fmt.Errorf("failed to read manifest %s: %w", sidecar, err)
+		}
+
+		var meta Metadata
+		if err := decodeManifest(sidecar, data, &meta); err != nil {
+			return nil, "", err
+		}
+		if found != nil {
+			return nil, "", fmt.Errorf("%s is described by both %s and %s", filepath.Base(path), foundIn, sidecar)
+		}
+		found, foundIn = &meta, sidecar
+	}
+
+	for _, name := range dirManifestNames {
+		dirManifest := filepath.Join(filepath.Dir(path), name)
+		data, err := os.ReadFile(dirManifest)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, "", fmt.Errorf("failed to read manifest %s: %w", dirManifest, err)
+		}
+
+		var manifest DirManifest
+		if err := decodeManifest(dirManifest, data, &manifest); err != nil {
+			return nil, "", err
+		}
+		meta, ok := manifest.Hashtabs[filepath.Base(path)]
+		if !ok {
+			continue
+		}
+		if found != nil {
+			return nil, "", fmt.Errorf("%s is described by both %s and %s", filepath.Base(path), foundIn, dirManifest)
+		}
+		found, foundIn = &meta, dirManifest
+	}
+
+	if found == nil {
+		return nil, "", nil
+	}
+	if err := found.validate(); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest %s for %s: %w", foundIn, filepath.Base(path), err)
+	}
+
+	return found, foundIn, nil
+}
+
+// decodeManifest decodes a JSON or YAML manifest, by extension, into v.
+// Unknown fields are rejected so a misspelt key is not silently ignored.
+func decodeManifest(path string, data []byte, v interface{}) error {
+	var err error
+	if strings.HasSuffix(path, ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+func (m *Metadata) validate() error {
+	if m.Version == "" {
+		return fmt.Errorf("version is required")
+	}
+	if _, err := ParseOSVersion(m.Version); err != nil {
+		return fmt.Errorf("invalid version %q: %w", m.Version, err)
+	}
+	if m.Device == "" {
+		return fmt.Errorf("device is required")
+	}
+	// Hashtab filenames separate the version and device with "-".
+	if strings.ContainsAny(m.Device, "- \t/") {
+		return fmt.Errorf("invalid device %q: must not contain '-', '/' or whitespace", m.Device)
+	}
+	if m.SHA256 != "" {
+		if b, err := hex.DecodeString(m.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 %q: must be %d hex characters", m.SHA256, 2*sha256.Size)
+		}
+	}
+	return nil
+}
+
+// applyMetadata sets the version and device of ht from meta, after checking
+// that meta agrees with the file: its checksum, if declared, and the version
+// entry, if the hashtab has one.
+func (ht *Hashtab) applyMetadata(meta *Metadata, manifestPath string) error {
+	if meta.SHA256 != "" && !strings.EqualFold(ht.SHA256(), meta.SHA256) {
+		return fmt.Errorf("checksum mismatch: %s declares sha256 %s, file has %s", manifestPath, meta.SHA256, ht.SHA256())
+	}
+
+	if embedded, ok := ht.Lookup(VersionHash); ok && embedded != meta.Version {
+		return fmt.Errorf("version mismatch: %s declares %s, hashtab contains %s", manifestPath, meta.Version, embedded)
+	}
+
+	ht.OSVersion = meta.Version
+	ht.Device = meta.Device
+	ht.Hardware = meta.Hardware
+	ht.Channel = meta.Channel
+	ht.Manifest = manifestPath
+	return nil
+}
@@ -0,0 +1,151 @@
+package hashtab
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDescribed(t *testing.T) {
+	tests := []struct {
+		name      string
+		hashtab   string
+		embedded  string
+		manifests map[string]string
+		version   string
+		device    string
+		channel   string
+		manifest  string
+		err       string
+	}{
+		{
+			name:      "sidecar",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.yaml": "version: 3.24.0.149\ndevice: rm2\nhardware: zero-sugar\n"},
+			version:   "3.24.0.149",
+			device:    "rm2",
+			manifest:  "rm2.hashtab.yaml",
+		},
+		{
+			name:      "directory manifest",
+			hashtab:   "rmpp.hashtab",
+			manifests: map[string]string{"hashtabs.json": `{"hashtabs": {"rmpp.hashtab": {"version": "3.24.0.149", "device": "rmpp", "channel": "beta"}}}`},
+			version:   "3.24.0.149",
+			device:    "rmpp",
+			channel:   "beta",
+			manifest:  "hashtabs.json",
+		},
+		{
+			name:      "not in directory manifest",
+			hashtab:   "3.22.0.64-rm2",
+			manifests: map[string]string{"hashtabs.yaml": "hashtabs:\n  rmpp.hashtab: {version: 3.24.0.149, device: rmpp}\n"},
+			version:   "3.22.0.64",
+			device:    "rm2",
+		},
+		{
+			name:      "matching embedded version",
+			hashtab:   "rm2.hashtab",
+			embedded:  "3.24.0.149",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24.0.149", "device": "rm2"}`},
+			version:   "3.24.0.149",
+			device:    "rm2",
+			manifest:  "rm2.hashtab.json",
+		},
+		{
+			name:      "unknown key",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.yaml": "version: 3.24.0.149\ndevice: rm2\ndevcie: rmpp\n"},
+			err:       "field devcie not found",
+		},
+		{
+			name:      "unparsable version",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24-beta", "device": "rm2"}`},
+			err:       `invalid version "3.24-beta"`,
+		},
+		{
+			name:      "no device",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24.0.149"}`},
+			err:       "device is required",
+		},
+		{
+			name:      "device with a dash",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24.0.149", "device": "rm-2"}`},
+			err:       `invalid device "rm-2"`,
+		},
+		{
+			name:      "checksum mismatch",
+			hashtab:   "rm2.hashtab",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24.0.149", "device": "rm2", "sha256": "` + strings.Repeat("0", 64) + `"}`},
+			err:       "checksum mismatch",
+		},
+		{
+			name:      "embedded version mismatch",
+			hashtab:   "rm2.hashtab",
+			embedded:  "3.22.0.64",
+			manifests: map[string]string{"rm2.hashtab.json": `{"version": "3.24.0.149", "device": "rm2"}`},
+			err:       "version mismatch",
+		},
+		{
+			name:    "described twice",
+			hashtab: "rm2.hashtab",
+			manifests: map[string]string{
+				"rm2.hashtab.yaml": "version: 3.24.0.149\ndevice: rm2\n",
+				"hashtabs.json":    `{"hashtabs": {"rm2.hashtab": {"version": "3.24.0.149", "device": "rm2"}}}`,
+			},
+			err: "described by both",
+		},
+		{
+			name:    "no device in filename",
+			hashtab: "rm2.hashtab",
+			err:     "cannot tell the device",
+		},
+		{
+			name:    "no version in filename",
+			hashtab: "latest-rm2",
+			err:     "cannot tell the OS version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries := map[uint64]string{1: "a"}
+			if tt.embedded != "" {
+				entries[VersionHash] = tt.embedded
+			}
+			path := filepath.Join(dir, tt.hashtab)
+			if err := Save(path, entries); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.manifests {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ht, err := loadDescribed(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			manifest := ""
+			if tt.manifest != "" {
+				manifest = filepath.Join(dir, tt.manifest)
+			}
+			if ht.OSVersion != tt.version || ht.Device != tt.device || ht.Channel != tt.channel || ht.Manifest != manifest {
+				t.Errorf("got version %q, device %q, channel %q, manifest %q; want %q, %q, %q, %q",
+					ht.OSVersion, ht.Device, ht.Channel, ht.Manifest, tt.version, tt.device, tt.channel, manifest)
+			}
+		})
+	}
+}
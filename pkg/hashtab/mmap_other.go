@@ -0,0 +1,11 @@
+//go:build !unix
+
+package hashtab
+
+import "os"
+
+// mapFile reads the contents of path. Memory-mapping is only used on unix.
+func mapFile(path string) ([]byte, func(), error) {
+	data, err := os.ReadFile(path)
+	return data, nil, err
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package hashtab
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapFile returns the contents of path, memory-mapped read-only when mmap is
+// enabled. The returned unmap func is nil when the data is an ordinary slice.
+func mapFile(path string) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	if !useMmap {
+		data, err := io.ReadAll(f)
+		return data, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		// Some filesystems cannot be mapped; read the file instead.
+		data, err := io.ReadAll(f)
+		return data, nil, err
+	}
+
+	return data, func() { syscall.Munmap(data) }, nil
+}
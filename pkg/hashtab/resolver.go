@@ -0,0 +1,30 @@
+package hashtab
+
+// Resolver looks hashes up across a set of hashtabs, typically every device
+// hashtab of one OS version.
+type Resolver struct {
+	hashtabs []*Hashtab
+}
+
+func NewResolver(hashtabs []*Hashtab) *Resolver {
+	return &Resolver{hashtabs: hashtabs}
+}
+
+// Lookup returns the first non-empty string any hashtab has for hash.
+// Hashlists only record that a hash exists, so they never resolve it.
+func (r *Resolver) Lookup(hash uint64) (string, bool) {
+	if hash == VersionHash {
+		return "", false
+	}
+	for _, ht := range r.hashtabs {
+		if str, ok := ht.Lookup(hash); ok && str != "" {
+			return str, true
+		}
+	}
+	return "", false
+}
+
+// ResolverForVersion returns a Resolver over every device hashtab of version.
+func (s *Service) ResolverForVersion(version string) *Resolver {
+	return NewResolver(s.GetHashtabsForVersion(version))
+}
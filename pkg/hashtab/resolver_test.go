@@ -0,0 +1,46 @@
+package hashtab
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolverLookup(t *testing.T) {
+	dir := t.TempDir()
+	save := func(name string, write func(string, map[uint64]string) error, entries map[uint64]string) *Hashtab {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := write(path, entries); err != nil {
+			t.Fatal(err)
+		}
+		ht, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ht
+	}
+
+	// The hashlist comes first, so a hash it has is still resolved from the
+	// hashtab after it.
+	r := NewResolver([]*Hashtab{
+		save("3.24-rmpp", SaveHashlist, map[uint64]string{1: "width", 3: "statusBar"}),
+		save("3.24-rm2", Save, map[uint64]string{1: "width", 2: "height", VersionHash: "3.24.0.149"}),
+	})
+
+	tests := []struct {
+		hash uint64
+		want string
+		ok   bool
+	}{
+		{1, "width", true},
+		{2, "height", true},
+		{3, "", false},
+		{VersionHash, "", false},
+		{4, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := r.Lookup(tt.hash); got != tt.want || ok != tt.ok {
+			t.Errorf("Lookup(%d) = %q, %t, want %q, %t", tt.hash, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -16,32 +16,56 @@ func shouldSkip(name string, isDir bool) bool {
 	if isDir {
 		return strings.HasPrefix(name, "@")
 	}
-	return strings.HasPrefix(name, ".") || strings.Contains(name, "@")
+	return strings.HasPrefix(name, ".") || strings.Contains(name, "@") || isManifest(name)
 }
 
 type VersionInfo struct {
 	Version     string   `json:"version"`
 	Devices     []string `json:"devices"`
 	DeviceCount int      `json:"deviceCount"`
+	// Loading is set while the version's hashtabs or GCD are still being
+	// prepared at startup.
+	Loading bool `json:"loading"`
 }
 
 type Service struct {
 	hashtables      []*Hashtab
 	dir             string
+	workers         int
 	mu              sync.RWMutex
+	reloadMu        sync.Mutex
 	modTimes        map[string]time.Time
+	byPath          map[string]*Hashtab
 	pathByName      map[string]string
 	byVersion       map[string][]*Hashtab
 	lastReloadCheck time.Time
+	watching        bool
+	listeners       []func(versions []string)
+	loaded          bool
+	loading         map[string]bool
+	loadErrors      map[string]string
+	// failed holds the modification time of each file in loadErrors.
+	failed map[string]time.Time
 }
 
-func NewService(dir string) (*Service, error) {
+// NewService creates a service for the hashtabs under dir. Nothing is loaded
+// until LoadAll is called; files are then parsed by up to workers goroutines.
+func NewService(dir string, workers int) (*Service, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
 	service := &Service{
 		hashtables: make([]*Hashtab, 0),
 		dir:        dir,
+		workers:    workers,
 		modTimes:   make(map[string]time.Time),
+		byPath:     make(map[string]*Hashtab),
 		pathByName: make(map[string]string),
 		byVersion:  make(map[string][]*Hashtab),
+		loading:    make(map[string]bool),
+		loadErrors: make(map[string]string),
+		failed:     make(map[string]time.Time),
 	}
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -50,90 +74,101 @@ func NewService(dir string) (*Service, error) {
 			return nil, fmt.Errorf("failed to create hashtable directory: %w", err)
 		}
 		logging.Info(logging.ComponentHashtab, "Created hashtable directory: %s", dir)
-		return service, nil
-	}
-
-	err := service.loadHashtables()
-	if err != nil {
-		return nil, err
 	}
 
 	return service, nil
 }
 
-func (s *Service) loadHashtables() error {
-	loadedNames := make(map[string]string)
-
-	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		name := d.Name()
-		if shouldSkip(name, d.IsDir()) {
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+// LoadAll loads every hashtab under the directory, one version at a time,
+// newest first. Each version's hashtabs become available as soon as they are
+// parsed; until then the version, from its manifests or file names, is
+// reported by LoadingVersions. Loaded reports false until every version is
+// done. The directory is then scanned again, so files added meanwhile are
+// loaded even if Watch was not running yet or skipped them.
+func (s *Service) LoadAll() error {
+	current, err := s.scan()
+	if err != nil {
+		s.mu.Lock()
+		s.loaded = true
+		s.mu.Unlock()
+		return fmt.Errorf("failed to walk hashtable directory: %w", err)
+	}
 
-		if d.IsDir() {
-			return nil
+	groups := make(map[string]map[string]time.Time)
+	s.mu.Lock()
+	for path, modTime := range current {
+		version, _ := ParseVersion(filepath.Base(path))
+		if meta, _, err := LoadMetadata(path); err == nil && meta != nil {
+			version = meta.Version
 		}
-
-		filename := filepath.Base(path)
-
-		if existingPath, exists := loadedNames[filename]; exists {
-			logging.Warn(logging.ComponentHashtab, "Skipping duplicate hashtable file %s (already loaded from %s)", path, existingPath)
-			return nil
+		if groups[version] == nil {
+			groups[version] = make(map[string]time.Time)
 		}
+		groups[version][path] = modTime
+		s.loading[version] = true
+	}
+	s.mu.Unlock()
 
-		logging.Info(logging.ComponentHashtab, "Loading hashtable: %s", filename)
-
-		ht, err := Load(path)
-		if err != nil {
-			logging.Error(logging.ComponentHashtab, "Failed to load hashtable %s: %v", filename, err)
-			return nil
-		}
+	versions := make([]string, 0, len(groups))
+	for v := range groups {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) > 0
+	})
 
-		formatType := "hashtab (with strings)"
-		if ht.IsHashlist() {
-			formatType = "hashlist (hash-only)"
+	done := make(map[string]time.Time, len(current))
+	for _, version := range versions {
+		for path, modTime := range groups[version] {
+			done[path] = modTime
 		}
-		logging.Info(logging.ComponentHashtab, "Loaded %s: %s, %d entries, version %s, device %s", filename, formatType, len(ht.Entries), ht.OSVersion, ht.Device)
-
-		s.hashtables = append(s.hashtables, ht)
-		loadedNames[filename] = path
-		s.pathByName[filename] = path
-
-		s.byVersion[ht.OSVersion] = append(s.byVersion[ht.OSVersion], ht)
+		s.reload(done)
 
-		fileInfo, err := d.Info()
-		if err == nil {
-			s.modTimes[path] = fileInfo.ModTime()
-		}
+		s.mu.Lock()
+		delete(s.loading, version)
+		s.mu.Unlock()
+	}
 
-		return nil
-	})
+	s.mu.Lock()
+	s.loaded = true
+	s.loading = make(map[string]bool)
+	s.mu.Unlock()
 
-	if err != nil {
+	if current, err = s.scan(); err != nil {
 		return fmt.Errorf("failed to walk hashtable directory: %w", err)
 	}
-
+	s.reload(current)
 	return nil
 }
 
-func (s *Service) CheckAndReload() (bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Loaded reports whether LoadAll has finished.
+func (s *Service) Loaded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loaded
+}
 
-	if time.Since(s.lastReloadCheck) < 5*time.Second {
-		return false, nil
+// LoadingVersions returns the versions, as declared by manifests or named by
+// hashtab files, that LoadAll has not finished loading yet, newest first.
+func (s *Service) LoadingVersions() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := make([]string, 0, len(s.loading))
+	for v := range s.loading {
+		versions = append(versions, v)
 	}
-	s.lastReloadCheck = time.Now()
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) > 0
+	})
+	return versions
+}
 
-	currentFiles := make(map[string]time.Time)
-	needsReload := false
+// scan returns the modification time of every hashtab file under the
+// directory, without reading any of them. A file's time is that of its
+// manifest instead when the manifest is newer.
+func (s *Service) scan() (map[string]time.Time, error) {
+	current := make(map[string]time.Time)
 
 	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
@@ -156,104 +191,265 @@ func (s *Service) CheckAndReload() (bool, error) {
 		if err != nil {
 			return nil
 		}
-
 		modTime := fileInfo.ModTime()
-		currentFiles[path] = modTime
-
-		if lastMod, exists := s.modTimes[path]; !exists || !lastMod.Equal(modTime) {
-			needsReload = true
+		if manifestTime := manifestModTime(path); manifestTime.After(modTime) {
+			modTime = manifestTime
 		}
+		current[path] = modTime
 
 		return nil
 	})
 
-	if err != nil {
-		return false, fmt.Errorf("failed to walk hashtable directory: %w", err)
-	}
+	return current, err
+}
 
-	if !needsReload {
-		for path := range s.modTimes {
-			if _, exists := currentFiles[path]; !exists {
-				needsReload = true
-				break
-			}
+// reload brings the loaded hashtabs in line with current, parsing only files
+// that are new or have a different modification time, then swaps in the new
+// indexes at once. It returns the versions whose hashtabs changed.
+func (s *Service) reload(current map[string]time.Time) []string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.RLock()
+	byPath := make(map[string]*Hashtab, len(current))
+	modTimes := make(map[string]time.Time, len(current))
+	affected := make(map[string]bool)
+	for path, ht := range s.byPath {
+		if modTime, ok := current[path]; ok && s.modTimes[path].Equal(modTime) {
+			byPath[path] = ht
+			modTimes[path] = modTime
+		} else {
+			affected[ht.OSVersion] = true
 		}
 	}
+	prevErrors, prevFailed := s.loadErrors, s.failed
+	s.mu.RUnlock()
 
-	if !needsReload {
-		return false, nil
+	paths := make([]string, 0, len(current))
+	for path := range current {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Files that failed to load are only retried once they change.
+	loadErrors := make(map[string]string)
+	failed := make(map[string]time.Time)
+	var pending []string
+	for _, path := range paths {
+		if _, ok := byPath[path]; ok {
+			continue
+		}
+		if modTime, ok := prevFailed[path]; ok && modTime.Equal(current[path]) {
+			loadErrors[path] = prevErrors[path]
+			failed[path] = modTime
+			continue
+		}
+		pending = append(pending, path)
 	}
 
-	logging.Info(logging.ComponentHashtab, "Detected hashtable changes, reloading...")
+	loaded, newErrors := s.loadFiles(pending)
+	for path, ht := range loaded {
+		byPath[path] = ht
+		modTimes[path] = current[path]
+		affected[ht.OSVersion] = true
+	}
+	for path, msg := range newErrors {
+		loadErrors[path] = msg
+		failed[path] = current[path]
+	}
 
-	s.hashtables = make([]*Hashtab, 0)
-	s.modTimes = make(map[string]time.Time)
-	s.pathByName = make(map[string]string)
-	s.byVersion = make(map[string][]*Hashtab)
+	s.mu.Lock()
+	s.loadErrors = loadErrors
+	s.failed = failed
+	s.mu.Unlock()
 
-	loadedNames := make(map[string]string)
+	if len(affected) == 0 {
+		return nil
+	}
 
-	err = filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
+	hashtables := make([]*Hashtab, 0, len(byPath))
+	pathByName := make(map[string]string, len(byPath))
+	byVersion := make(map[string][]*Hashtab)
+	for _, path := range paths {
+		ht, ok := byPath[path]
+		if !ok {
+			continue
 		}
 
-		name := d.Name()
-		if shouldSkip(name, d.IsDir()) {
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
+		filename := filepath.Base(path)
+		if existingPath, exists := pathByName[filename]; exists {
+			logging.Warn(logging.ComponentHashtab, "Skipping duplicate hashtable file %s (already loaded from %s)", path, existingPath)
+			continue
 		}
 
-		if d.IsDir() {
-			return nil
-		}
+		hashtables = append(hashtables, ht)
+		pathByName[filename] = path
+		byVersion[ht.OSVersion] = append(byVersion[ht.OSVersion], ht)
+	}
 
-		filename := filepath.Base(path)
+	s.mu.Lock()
+	s.hashtables = hashtables
+	s.byPath = byPath
+	s.modTimes = modTimes
+	s.pathByName = pathByName
+	s.byVersion = byVersion
+	s.mu.Unlock()
+
+	versions := make([]string, 0, len(affected))
+	for v := range affected {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) > 0
+	})
 
-		if existingPath, exists := loadedNames[filename]; exists {
-			logging.Warn(logging.ComponentHashtab, "Skipping duplicate hashtable file %s (already loaded from %s)", path, existingPath)
-			return nil
-		}
+	return versions
+}
 
-		logging.Info(logging.ComponentHashtab, "Loading hashtable: %s", filename)
+// loadFiles parses paths with up to s.workers goroutines. Files that fail to
+// load are logged and returned by path in the errors map instead.
+func (s *Service) loadFiles(paths []string) (map[string]*Hashtab, map[string]string) {
+	loaded := make(map[string]*Hashtab, len(paths))
+	failed := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	work := make(chan string)
+	for i := 0; i < min(s.workers, len(paths)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				filename := filepath.Base(path)
+				logging.Info(logging.ComponentHashtab, "Loading hashtable: %s", filename)
+
+				ht, err := loadDescribed(path)
+				if err != nil {
+					logging.Error(logging.ComponentHashtab, "Failed to load hashtable %s: %v", filename, err)
+					mu.Lock()
+					failed[path] = err.Error()
+					mu.Unlock()
+					continue
+				}
+
+				formatType := "hashtab (with strings)"
+				if ht.IsHashlist() {
+					formatType = "hashlist (hash-only)"
+				}
+				logging.Info(logging.ComponentHashtab, "Loaded %s: %s, %d entries, version %s, device %s", filename, formatType, ht.Len(), ht.OSVersion, ht.Device)
+
+				mu.Lock()
+				loaded[path] = ht
+				mu.Unlock()
+			}
+		}()
+	}
 
-		ht, err := Load(path)
-		if err != nil {
-			logging.Error(logging.ComponentHashtab, "Failed to load hashtable %s: %v", filename, err)
-			return nil
-		}
+	for _, path := range paths {
+		work <- path
+	}
+	close(work)
+	wg.Wait()
 
-		formatType := "hashtab (with strings)"
-		if ht.IsHashlist() {
-			formatType = "hashlist (hash-only)"
-		}
-		logging.Info(logging.ComponentHashtab, "Loaded %s: %s, %d entries, version %s", filename, formatType, len(ht.Entries), ht.OSVersion)
+	return loaded, failed
+}
 
-		s.hashtables = append(s.hashtables, ht)
-		loadedNames[filename] = path
-		s.pathByName[filename] = path
+// loadDescribed loads the hashtab at path and applies its manifest, if it has
+// one. Without a manifest the version and device come from the filename, which
+// must then name a device.
+func loadDescribed(path string) (*Hashtab, error) {
+	meta, manifestPath, err := LoadMetadata(path)
+	if err != nil {
+		return nil, err
+	}
 
-		s.byVersion[ht.OSVersion] = append(s.byVersion[ht.OSVersion], ht)
+	ht, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
 
-		fileInfo, err := d.Info()
-		if err == nil {
-			s.modTimes[path] = fileInfo.ModTime()
+	if meta != nil {
+		if err := ht.applyMetadata(meta, manifestPath); err != nil {
+			return nil, err
 		}
+		return ht, nil
+	}
 
-		return nil
-	})
+	if ht.Device == "unknown" || ht.Device == "" {
+		return nil, fmt.Errorf("cannot tell the device of %s: name it <version>-<device> or describe it in a manifest", ht.Name)
+	}
+	// Versions are ordered and matched numerically, so one that does not
+	// parse could never be selected by a range.
+	if _, err := ParseOSVersion(ht.OSVersion); err != nil {
+		return nil, fmt.Errorf("cannot tell the OS version of %s: %w", ht.Name, err)
+	}
 
+	return ht, nil
+}
+
+// LoadErrors returns, by path, why each hashtab file that failed to load in
+// the latest reload was rejected.
+func (s *Service) LoadErrors() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]string, len(s.loadErrors))
+	for k, v := range s.loadErrors {
+		result[k] = v
+	}
+	return result
+}
+
+// CheckAndReload rescans the directory, at most every 5 seconds, and reloads
+// the hashtabs that changed. It does nothing while Watch is running, as the
+// watcher already keeps the hashtabs current, or before LoadAll has finished.
+func (s *Service) CheckAndReload() (bool, error) {
+	s.mu.Lock()
+	if s.watching || !s.loaded || time.Since(s.lastReloadCheck) < 5*time.Second {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.lastReloadCheck = time.Now()
+	s.mu.Unlock()
+
+	current, err := s.scan()
 	if err != nil {
-		return false, fmt.Errorf("failed to reload hashtables: %w", err)
+		return false, fmt.Errorf("failed to walk hashtable directory: %w", err)
 	}
 
-	logging.Info(logging.ComponentHashtab, "Reload complete: %d hashtables loaded", len(s.hashtables))
+	versions := s.reload(current)
+	if len(versions) == 0 {
+		return false, nil
+	}
+
+	logging.Info(logging.ComponentHashtab, "Reload complete: %d hashtables loaded, versions changed: %v", len(s.GetHashtables()), versions)
+	s.notify(versions)
 
 	return true, nil
 }
 
+// OnReload registers fn to be called with the affected versions whenever a
+// reload changes the loaded hashtabs.
+func (s *Service) OnReload(fn func(versions []string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+func (s *Service) notify(versions []string) {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(versions)
+	}
+}
+
+// Dir returns the directory the hashtabs are loaded from.
+func (s *Service) Dir() string {
+	return s.dir
+}
+
 func (s *Service) GetHashtables() []*Hashtab {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -296,7 +492,7 @@ func (s *Service) GetVersions() []VersionInfo {
 	}
 
 	sort.Slice(versions, func(i, j int) bool {
-		return versions[i].Version > versions[j].Version
+		return CompareVersions(versions[i].Version, versions[j].Version) > 0
 	})
 
 	return versions
@@ -311,3 +507,26 @@ func (s *Service) GetModTimes() map[string]time.Time {
 	}
 	return result
 }
+
+// GetVersionsMatching returns the loaded versions satisfying a constraint
+// expression such as "3.22-3.24" or ">=3.22 <3.25", newest first.
+func (s *Service) GetVersionsMatching(expr string) ([]VersionInfo, error) {
+	constraints, err := ParseConstraints(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := s.GetVersions()
+	matched := make([]VersionInfo, 0, len(versions))
+	for _, v := range versions {
+		parsed, err := ParseOSVersion(v.Version)
+		if err != nil {
+			continue
+		}
+		if constraints.Check(parsed) {
+			matched = append(matched, v)
+		}
+	}
+
+	return matched, nil
+}
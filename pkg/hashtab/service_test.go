@@ -0,0 +1,56 @@
+package hashtab
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAll(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"3.22-rm2", "3.24-rm2", "3.24-rmpp"} {
+		if err := Save(filepath.Join(dir, name), map[uint64]string{1: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := filepath.Join(dir, "3.20-rm2")
+	if err := os.WriteFile(broken, encode(rawEntry{1, "abc"})[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewService(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Loaded() || len(s.LoadingVersions()) != 0 {
+		t.Errorf("Loaded = %v, LoadingVersions = %v after LoadAll", s.Loaded(), s.LoadingVersions())
+	}
+	var versions []string
+	for _, v := range s.GetVersions() {
+		versions = append(versions, v.Version)
+	}
+	if want := []string{"3.24", "3.22"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("versions = %v, want %v", versions, want)
+	}
+	if _, ok := s.LoadErrors()[broken]; !ok || len(s.LoadErrors()) != 1 {
+		t.Errorf("LoadErrors = %v, want only %s", s.LoadErrors(), broken)
+	}
+
+	if err := Save(filepath.Join(dir, "3.25-rm2"), map[uint64]string{1: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := s.CheckAndReload(); err != nil || !changed {
+		t.Fatalf("CheckAndReload = %v, %v, want a change", changed, err)
+	}
+	if len(s.GetHashtabsForVersion("3.25")) != 1 {
+		t.Error("hashtab added after LoadAll was not loaded")
+	}
+	if _, ok := s.LoadErrors()[broken]; !ok {
+		t.Errorf("LoadErrors = %v, lost the unchanged broken file", s.LoadErrors())
+	}
+}
@@ -0,0 +1,180 @@
+package hashtab
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OSVersion is a dotted reMarkable OS version such as 3.24.0.149.
+type OSVersion struct {
+	raw   string
+	parts []uint64
+}
+
+func ParseOSVersion(s string) (OSVersion, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return OSVersion{}, fmt.Errorf("empty version")
+	}
+
+	fields := strings.Split(s, ".")
+	parts := make([]uint64, len(fields))
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return OSVersion{}, fmt.Errorf("invalid version %q: component %q is not a number", s, f)
+		}
+		parts[i] = n
+	}
+
+	return OSVersion{raw: s, parts: parts}, nil
+}
+
+func (v OSVersion) String() string {
+	return v.raw
+}
+
+// Compare orders versions component by component. A version that is a prefix
+// of another sorts first, so 3.22 < 3.22.0.64 < 3.22.1.
+func (v OSVersion) Compare(o OSVersion) int {
+	return compareParts(v.parts, o.parts)
+}
+
+func compareParts(a, b []uint64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// CompareVersions compares two version strings. Versions that do not parse
+// sort before every version that does, and among themselves by string, so the
+// order stays consistent for sorting.
+func CompareVersions(a, b string) int {
+	va, errA := ParseOSVersion(a)
+	vb, errB := ParseOSVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
+
+type Constraint struct {
+	Op      string
+	Version OSVersion
+}
+
+// Check compares v against the constraint using only as many components as
+// the constraint specifies, so "=3.24" matches every 3.24.x build, "<=3.24"
+// includes them and ">3.24" excludes them.
+func (c Constraint) Check(v OSVersion) bool {
+	parts := v.parts
+	if len(parts) > len(c.Version.parts) {
+		parts = parts[:len(c.Version.parts)]
+	}
+	cmp := compareParts(parts, c.Version.parts)
+
+	switch c.Op {
+	case "=", "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+func (c Constraint) String() string {
+	return c.Op + c.Version.String()
+}
+
+// Constraints is a conjunction: a version matches when it satisfies all of them.
+type Constraints []Constraint
+
+func (cs Constraints) Check(v OSVersion) bool {
+	for _, c := range cs {
+		if !c.Check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs Constraints) String() string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+var (
+	rangePattern      = regexp.MustCompile(`^\s*([0-9][0-9.]*)\s*[-–]\s*([0-9][0-9.]*)\s*$`)
+	constraintPattern = regexp.MustCompile(`(>=|<=|!=|==|=|>|<)?\s*([0-9][0-9.]*)`)
+)
+
+// ParseConstraints parses a version filter. It accepts a hyphenated range such
+// as "3.22-3.24" (inclusive on both ends), or a list of comparisons separated
+// by spaces or commas such as ">=3.22 <3.25". A bare version means "=".
+func ParseConstraints(expr string) (Constraints, error) {
+	if m := rangePattern.FindStringSubmatch(expr); m != nil {
+		return parseConstraintList(">=" + m[1] + " <=" + m[2])
+	}
+	return parseConstraintList(expr)
+}
+
+func parseConstraintList(expr string) (Constraints, error) {
+	var cs Constraints
+
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		loc := constraintPattern.FindStringSubmatchIndex(rest)
+		if loc == nil || loc[0] != 0 {
+			return nil, fmt.Errorf("invalid version constraint %q", expr)
+		}
+
+		op := "="
+		if loc[2] >= 0 {
+			op = rest[loc[2]:loc[3]]
+		}
+		v, err := ParseOSVersion(strings.TrimSuffix(rest[loc[4]:loc[5]], "."))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", expr, err)
+		}
+		cs = append(cs, Constraint{Op: op, Version: v})
+
+		rest = strings.TrimLeft(rest[loc[1]:], " \t,")
+	}
+
+	if len(cs) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+
+	return cs, nil
+}
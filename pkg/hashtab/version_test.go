@@ -0,0 +1,132 @@
+package hashtab
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestParseOSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "3.24.0.149"},
+		{in: " 3.22 "},
+		{in: "3"},
+		{in: "", wantErr: true},
+		{in: "3.24-beta", wantErr: true},
+		{in: "3..24", wantErr: true},
+		{in: "v3.24", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseOSVersion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseOSVersion(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"3.22", "3.22", 0},
+		{"3.9", "3.10", -1},
+		{"3.22", "3.22.0.64", -1},
+		{"3.22.0.64", "3.22.1", -1},
+		{"3.24.0.149", "3.22.0.64", 1},
+		{"beta", "3.0", -1},
+		{"3.0", "beta", 1},
+		{"alpha", "beta", -1},
+	}
+
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareVersionsSortsConsistently(t *testing.T) {
+	versions := []string{"3.10", "x", "3.9", "3.22.0.64", "a", "3.22"}
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) < 0
+	})
+
+	want := []string{"a", "x", "3.9", "3.10", "3.22", "3.22.0.64"}
+	for i := range want {
+		if versions[i] != want[i] {
+			t.Fatalf("sorted = %v, want %v", versions, want)
+		}
+	}
+}
+
+func TestParseConstraints(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "3.22-3.24", want: ">=3.22 <=3.24"},
+		{expr: "3.22 – 3.24", want: ">=3.22 <=3.24"},
+		{expr: ">=3.22 <3.25", want: ">=3.22 <3.25"},
+		{expr: ">=3.22, <3.25", want: ">=3.22 <3.25"},
+		{expr: "3.24", want: "=3.24"},
+		{expr: "!=3.23", want: "!=3.23"},
+		{expr: "", wantErr: true},
+		{expr: "latest", wantErr: true},
+		{expr: ">=3.22 garbage", wantErr: true},
+		{expr: "~3.22", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseConstraints(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseConstraints(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseConstraints(%q) = %q, want %q", tt.expr, got.String(), tt.want)
+		}
+	}
+}
+
+func TestConstraintsCheck(t *testing.T) {
+	tests := []struct {
+		expr    string
+		version string
+		want    bool
+	}{
+		{"3.22-3.24", "3.22.0.64", true},
+		{"3.22-3.24", "3.24.0.149", true},
+		{"3.22-3.24", "3.21.9", false},
+		{"3.22-3.24", "3.25", false},
+		{"=3.24", "3.24.0.149", true},
+		{"=3.24", "3.25.0.1", false},
+		{">3.24", "3.24.0.149", false},
+		{">3.24", "3.25", true},
+		{"<=3.24", "3.24.9.9", true},
+		{"<3.24", "3.24.0.1", false},
+		{">=3.22 <3.25", "3.24.1", true},
+		{">=3.22 <3.25", "3.25.0.1", false},
+		{"!=3.23", "3.23.0.1", false},
+		{"!=3.23", "3.24", true},
+		{"=3.24.0.149", "3.24", false},
+	}
+
+	for _, tt := range tests {
+		cs, err := ParseConstraints(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseConstraints(%q): %v", tt.expr, err)
+		}
+		v, err := ParseOSVersion(tt.version)
+		if err != nil {
+			t.Fatalf("ParseOSVersion(%q): %v", tt.version, err)
+		}
+		if got := cs.Check(v); got != tt.want {
+			t.Errorf("%q.Check(%q) = %v, want %v", tt.expr, tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package hashtab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/rmitchellscott/rm-qmd-hasher/internal/logging"
+)
+
+// watchDebounce is how long the directory must be quiet before a reload, so a
+// hashtab being copied in is only parsed once it is complete.
+const watchDebounce = time.Second
+
+// Watch reloads hashtabs as files under the directory are added, changed or
+// removed, and stops polling in CheckAndReload. Only the affected files are
+// reparsed. It may be started before LoadAll, which picks up changes made
+// while it runs. It returns a function that stops watching.
+func (s *Service) Watch() (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hashtab watcher: %w", err)
+	}
+
+	if err := s.watchTree(watcher, s.dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.watching = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go s.watchLoop(watcher, done)
+
+	logging.Info(logging.ComponentHashtab, "Watching %s for hashtab changes", s.dir)
+
+	stop := func() {
+		close(done)
+		watcher.Close()
+		s.mu.Lock()
+		s.watching = false
+		s.mu.Unlock()
+	}
+	return stop, nil
+}
+
+// watchTree adds dir and its subdirectories to watcher, as fsnotify does not
+// watch recursively.
+func (s *Service) watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && shouldSkip(d.Name(), true) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func (s *Service) watchLoop(watcher *fsnotify.Watcher, done chan struct{}) {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			timer.Stop()
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := s.watchTree(watcher, event.Name); err != nil {
+						logging.Warn(logging.ComponentHashtab, "%v", err)
+					}
+				}
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			timer.Reset(watchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logging.Warn(logging.ComponentHashtab, "Hashtab watcher error: %v", err)
+
+		case <-timer.C:
+			// LoadAll rescans when it finishes.
+			if !s.Loaded() {
+				continue
+			}
+			current, err := s.scan()
+			if err != nil {
+				logging.Error(logging.ComponentHashtab, "Failed to walk hashtable directory: %v", err)
+				continue
+			}
+			versions := s.reload(current)
+			if len(versions) == 0 {
+				continue
+			}
+			logging.Info(logging.ComponentHashtab, "Reload complete: %d hashtables loaded, versions changed: %v", len(s.GetHashtables()), versions)
+			s.notify(versions)
+		}
+	}
+}
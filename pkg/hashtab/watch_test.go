@@ -0,0 +1,81 @@
+package hashtab
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchReloads(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"3.22-rm2", "3.24-rm2"} {
+		if err := Save(filepath.Join(dir, name), map[uint64]string{1: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewService(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan []string, 10)
+	s.OnReload(func(versions []string) { reloaded <- versions })
+
+	stop, err := s.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if err := s.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := s.GetHashtabsForVersion("3.24")[0]
+
+	// Each change is reloaded once the directory is quiet, reporting only the
+	// versions it touched.
+	expectReload := func(want []string, versions ...string) {
+		t.Helper()
+		select {
+		case got := <-reloaded:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("reloaded versions = %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reload for %v", want)
+		}
+		var loaded []string
+		for _, v := range s.GetVersions() {
+			loaded = append(loaded, v.Version)
+		}
+		if !reflect.DeepEqual(loaded, versions) {
+			t.Errorf("versions = %v, want %v", loaded, versions)
+		}
+	}
+
+	if err := Save(filepath.Join(dir, "3.25-rm2"), map[uint64]string{1: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// The watcher reloads instead, so polling is off.
+	if changed, err := s.CheckAndReload(); changed || err != nil {
+		t.Errorf("CheckAndReload while watching = %v, %v, want false, nil", changed, err)
+	}
+	expectReload([]string{"3.25"}, "3.25", "3.24", "3.22")
+	if s.GetHashtabsForVersion("3.24")[0] != unchanged {
+		t.Error("unchanged hashtab was reparsed")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "3.22-rm2")); err != nil {
+		t.Fatal(err)
+	}
+	expectReload([]string{"3.22"}, "3.25", "3.24")
+
+	if err := Save(filepath.Join(dir, "3.24-rm2"), map[uint64]string{1: "a", 2: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expectReload([]string{"3.24"}, "3.25", "3.24")
+	if ht := s.GetHashtabsForVersion("3.24")[0]; ht == unchanged || ht.Len() != 2 {
+		t.Errorf("changed hashtab was not reparsed: %d entries", ht.Len())
+	}
+}
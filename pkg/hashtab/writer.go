@@ -0,0 +1,165 @@
+package hashtab
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+type Writer struct {
+	w        *bufio.Writer
+	hashOnly bool
+}
+
+// NewWriter returns a Writer that emits full hashtab entries (hash + string).
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// NewHashlistWriter returns a Writer that emits hash-only entries. The version
+// entry keeps its string so the result still loads with the right OS version.
+func NewHashlistWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), hashOnly: true}
+}
+
+// WriteEntry writes one entry. Hash 0 is skipped, as Load ignores it.
+func (w *Writer) WriteEntry(hash uint64, value string) error {
+	if hash == 0 {
+		return nil
+	}
+	if w.hashOnly && hash != VersionHash {
+		value = ""
+	}
+
+	if len(value) > maxStringLength {
+		return fmt.Errorf("string length %d exceeds maximum %d", len(value), maxStringLength)
+	}
+
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[0:8], hash)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(value)))
+
+	if _, err := w.w.Write(header[:]); err != nil {
+		return fmt.Errorf("failed to write entry header: %w", err)
+	}
+	if _, err := w.w.WriteString(value); err != nil {
+		return fmt.Errorf("failed to write string data: %w", err)
+	}
+
+	return nil
+}
+
+// WriteEntries writes entries in canonical order: the version entry first,
+// then the remaining hashes in ascending order. Writing the same entries always
+// produces the same bytes, but not necessarily those of the file the entries
+// were read from; use Hashtab.Save for an exact copy.
+func (w *Writer) WriteEntries(entries map[uint64]string) error {
+	if version, ok := entries[VersionHash]; ok {
+		if err := w.WriteEntry(VersionHash, version); err != nil {
+			return err
+		}
+	}
+
+	for _, hash := range sortedHashes(entries) {
+		if hash == VersionHash {
+			continue
+		}
+		if err := w.WriteEntry(hash, entries[hash]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func sortedHashes(entries map[uint64]string) []uint64 {
+	hashes := make([]uint64, 0, len(entries))
+	for hash := range entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i] < hashes[j]
+	})
+	return hashes
+}
+
+// Save writes entries as a full hashtab to path, in the canonical order of
+// WriteEntries. The file is written to a temporary name and renamed into place
+// so readers never see a partial file.
+func Save(path string, entries map[uint64]string) error {
+	return save(path, func(f io.Writer) error {
+		return writeEntries(NewWriter(f), entries)
+	})
+}
+
+// SaveHashlist writes entries as a hash-only hashlist to path.
+func SaveHashlist(path string, entries map[uint64]string) error {
+	return save(path, func(f io.Writer) error {
+		return writeEntries(NewHashlistWriter(f), entries)
+	})
+}
+
+// Save writes the hashtab to path exactly as it was loaded, so the copy is
+// byte-identical to the original file, including entry order, repeated
+// hashes and hash 0 entries that Load ignores.
+func (ht *Hashtab) Save(path string) error {
+	return save(path, func(f io.Writer) error {
+		_, err := f.Write(ht.data)
+		runtime.KeepAlive(ht)
+		if err != nil {
+			return fmt.Errorf("failed to write hashtab data: %w", err)
+		}
+		return nil
+	})
+}
+
+func writeEntries(w *Writer, entries map[uint64]string) error {
+	if err := w.WriteEntries(entries); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush hashtab file: %w", err)
+	}
+	return nil
+}
+
+func save(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create hashtab file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to set hashtab file permissions: %w", err)
+	}
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close hashtab file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename hashtab file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package hashtab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rawEntry is one entry of a hand-built hashtab file.
+type rawEntry struct {
+	hash  uint64
+	value string
+}
+
+// encode builds raw hashtab bytes from entries in the given order.
+func encode(entries ...rawEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		var header [12]byte
+		binary.BigEndian.PutUint64(header[0:8], e.hash)
+		binary.BigEndian.PutUint32(header[8:12], uint32(len(e.value)))
+		buf.Write(header[:])
+		buf.WriteString(e.value)
+	}
+	return buf.Bytes()
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashlist bool
+		entries  map[uint64]string
+		want     map[uint64]string
+	}{
+		{
+			name:    "hashtab",
+			entries: map[uint64]string{VersionHash: "3.24.0.149", 1: "a", 42: "width", 7: ""},
+			want:    map[uint64]string{VersionHash: "3.24.0.149", 1: "a", 42: "width", 7: ""},
+		},
+		{
+			name:     "hashlist keeps the version string",
+			hashlist: true,
+			entries:  map[uint64]string{VersionHash: "3.24.0.149", 1: "a", 42: "width"},
+			want:     map[uint64]string{VersionHash: "3.24.0.149", 1: "", 42: ""},
+		},
+		{
+			name:    "hash 0 is not written",
+			entries: map[uint64]string{0: "zero", 1: "a"},
+			want:    map[uint64]string{1: "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "3.24.0.149-rm2")
+			save := Save
+			if tt.hashlist {
+				save = SaveHashlist
+			}
+			if err := save(path, tt.entries); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+
+			ht, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := ht.Entries(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+			if ht.IsHashlist() != tt.hashlist {
+				t.Errorf("IsHashlist = %v, want %v", ht.IsHashlist(), tt.hashlist)
+			}
+		})
+	}
+}
+
+func TestWriteEntriesCanonical(t *testing.T) {
+	entries := map[uint64]string{3: "c", VersionHash: "3.24", 1: "a", 2: "b"}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := encode(rawEntry{VersionHash, "3.24"}, rawEntry{1, "a"}, rawEntry{2, "b"}, rawEntry{3, "c"})
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WriteEntries output is not in canonical order")
+	}
+}
+
+func TestWriteEntryRejectsLongString(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	if err := w.WriteEntry(1, string(make([]byte, maxStringLength+1))); err == nil {
+		t.Error("WriteEntry accepted a string longer than the maximum")
+	}
+}
+
+func TestHashtabSaveIsByteIdentical(t *testing.T) {
+	// Out of order, with a repeated hash and a hash 0 entry, as qmldiff may
+	// produce; Load normalises these, Save must not.
+	original := encode(
+		rawEntry{5, "e"},
+		rawEntry{VersionHash, "3.24.0.149"},
+		rawEntry{0, ""},
+		rawEntry{2, "b"},
+		rawEntry{5, "e2"},
+	)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "3.24.0.149-rm2")
+	if err := os.WriteFile(src, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ht, err := Load(src)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	dst := filepath.Join(dir, "copy")
+	if err := ht.Save(dst); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	saved, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, original) {
+		t.Errorf("saved file differs from the original")
+	}
+}
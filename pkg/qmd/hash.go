@@ -0,0 +1,97 @@
+package qmd
+
+import "regexp"
+
+// hashablePattern matches already hashed identifiers, which are kept as they
+// are, and the same candidates as identifierPattern.
+var hashablePattern = regexp.MustCompile(`\[\[\d+\]\]|[A-Za-z_$][\w$]*|"[^"\n]*"|'[^'\n]*'`)
+
+// keywords are QMD directives, which are never hashed.
+var keywords = map[string]bool{
+	"AFFECT": true, "TRAVERSE": true, "LOCATE": true, "INSERT": true,
+	"REPLACE": true, "REMOVE": true, "REBUILD": true, "RENAME": true,
+	"IMPORT": true, "LOAD": true, "SLOT": true, "TEMPLATE": true,
+	"END": true, "ALL": true, "AFTER": true, "BEFORE": true,
+	"WITH": true, "TO": true, "ASSERT": true, "VERSION": true,
+}
+
+// IsKeyword reports whether s is a QMD directive rather than an identifier.
+func IsKeyword(s string) bool {
+	return keywords[s]
+}
+
+// Hash replaces every identifier, and the contents of every quoted string,
+// for which lookup returns a hash with the hashed form of that hash. Quotes
+// are kept. Anything lookup rejects is left untouched and returned, once
+// each, in order of first appearance.
+func Hash(content []byte, lookup func(string) (uint64, bool)) ([]byte, []string) {
+	seen := make(map[string]bool)
+	var unresolved []string
+	reject := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			unresolved = append(unresolved, s)
+		}
+	}
+
+	out := hashablePattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		if match[0] == '[' {
+			return match
+		}
+
+		if match[0] == '"' || match[0] == '\'' {
+			inner := string(match[1 : len(match)-1])
+			if inner == "" {
+				return match
+			}
+			hash, ok := lookup(inner)
+			if !ok {
+				reject(inner)
+				return match
+			}
+			return []byte(string(match[0]) + FormatHashed(hash) + string(match[0]))
+		}
+
+		id := string(match)
+		if keywords[id] {
+			return match
+		}
+		if hash, ok := lookup(id); ok {
+			return []byte(FormatHashed(hash))
+		}
+		reject(id)
+		return match
+	})
+
+	return out, unresolved
+}
+
+// Unhashed returns the distinct identifiers, and contents of quoted strings,
+// that are still in plain form in hashed content, in order of first
+// appearance. QMD directives are left out.
+func Unhashed(content []byte) []string {
+	seen := make(map[string]bool)
+	var ids []string
+
+	for _, match := range hashablePattern.FindAll(content, -1) {
+		id := string(match)
+		switch {
+		case match[0] == '[':
+			continue
+		case match[0] == '"' || match[0] == '\'':
+			id = id[1 : len(id)-1]
+			if hashedPattern.FindString(id) == id {
+				continue
+			}
+		case keywords[id]:
+			continue
+		}
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids
+}
@@ -0,0 +1,20 @@
+package qmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnhashed(t *testing.T) {
+	content := []byte(`AFFECT [[1]] {
+	[[2]]: "[[3]]"
+	label: "Hello"
+	width: label
+	INSERT { text: '' }
+}`)
+
+	want := []string{"label", "Hello", "width", "text"}
+	if got := Unhashed(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unhashed = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+package qmd
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// hashedPattern matches a hashed identifier as emitted by qmldiff hash-diffs,
+// e.g. [[1234567890123]].
+var hashedPattern = regexp.MustCompile(`\[\[(\d+)\]\]`)
+
+// FormatHashed renders hash in the hashed-identifier syntax.
+func FormatHashed(hash uint64) string {
+	return "[[" + strconv.FormatUint(hash, 10) + "]]"
+}
+
+// HashedRefs returns the distinct hashes referenced in content, in order of
+// first appearance.
+func HashedRefs(content []byte) []uint64 {
+	seen := make(map[uint64]bool)
+	var refs []uint64
+
+	for _, m := range hashedPattern.FindAllSubmatch(content, -1) {
+		hash, err := strconv.ParseUint(string(m[1]), 10, 64)
+		if err != nil || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		refs = append(refs, hash)
+	}
+
+	return refs
+}
+
+// Unhash replaces every hashed identifier that lookup resolves with its
+// string and leaves the rest untouched. It returns the rewritten content and
+// the distinct hashes that could not be resolved.
+func Unhash(content []byte, lookup func(uint64) (string, bool)) ([]byte, []uint64) {
+	seen := make(map[uint64]bool)
+	var unresolved []uint64
+
+	out := hashedPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		hash, err := strconv.ParseUint(string(match[2:len(match)-2]), 10, 64)
+		if err != nil {
+			return match
+		}
+		if str, ok := lookup(hash); ok {
+			return []byte(str)
+		}
+		if !seen[hash] {
+			seen[hash] = true
+			unresolved = append(unresolved, hash)
+		}
+		return match
+	})
+
+	return out, unresolved
+}
@@ -0,0 +1,40 @@
+package qmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnhash(t *testing.T) {
+	names := map[uint64]string{1: "width", 2: "statusBar"}
+	lookup := func(hash uint64) (string, bool) {
+		s, ok := names[hash]
+		return s, ok
+	}
+
+	content := []byte(`AFFECT [[2]] {
+	[[1]]: [[3]]
+	text: "[[1]]"
+	id: [[3]]; [[99999999999999999999999]]
+}`)
+	got, unresolved := Unhash(content, lookup)
+
+	want := `AFFECT statusBar {
+	width: [[3]]
+	text: "width"
+	id: [[3]]; [[99999999999999999999999]]
+}`
+	if string(got) != want {
+		t.Errorf("Unhash =\n%s\nwant\n%s", got, want)
+	}
+	if !reflect.DeepEqual(unresolved, []uint64{3}) {
+		t.Errorf("unresolved = %v, want [3]", unresolved)
+	}
+}
+
+func TestHashedRefs(t *testing.T) {
+	content := []byte(`AFFECT [[2]] { [[1]]: "[[2]]"; id: [1]; [[99999999999999999999999]]; [[3]] }`)
+	if got, want := HashedRefs(content), []uint64{2, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HashedRefs = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package qmd
+
+import "regexp"
+
+// identifierPattern matches the candidates for hashing in unhashed QMD: bare
+// identifiers and the contents of quoted strings.
+var identifierPattern = regexp.MustCompile(`[A-Za-z_$][\w$]*|"([^"\n]*)"|'([^'\n]*)'`)
+
+// Identifiers returns the distinct identifiers and quoted strings in content,
+// in order of first appearance. It is deliberately loose: callers look the
+// results up in a hashtab, which filters out anything that is not a real
+// identifier.
+func Identifiers(content []byte) []string {
+	seen := make(map[string]bool)
+	var ids []string
+
+	for _, m := range identifierPattern.FindAllSubmatch(content, -1) {
+		id := string(m[0])
+		if m[1] != nil {
+			id = string(m[1])
+		} else if m[2] != nil {
+			id = string(m[2])
+		}
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids
+}